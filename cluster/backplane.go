@@ -0,0 +1,42 @@
+package cluster
+
+import (
+	"encoding/json"
+)
+
+// Kinds of the messages travelling between the realtime nodes
+const (
+	KIND_ONLINE    = "online"
+	KIND_OFFLINE   = "offline"
+	KIND_REFRESH   = "refresh" // The periodic []Announcement of a node, also telling it is alive
+	KIND_NODE_DOWN = "nodedown"
+	KIND_COUNTER   = "counter"
+	KIND_TOPIC     = "topic"
+)
+
+type Message struct {
+	Kind    string
+	NodeId  string // The sender node
+	To      string // The target node, empty for all nodes
+	OrgId   string
+	UserId  string
+	Payload json.RawMessage
+}
+
+// What a node tells about one of its users in a refresh
+type Announcement struct {
+	OrgId  string
+	UserId string
+	Status
+}
+
+type Handler func(msg *Message)
+
+// The pub/sub channel shared by all the nodes of a cluster.
+// Every published message is delivered to the handlers of every node,
+// including the publishing one.
+type Backplane interface {
+	Publish(msg *Message) error
+	Subscribe(handler Handler)
+	Close() error
+}
@@ -0,0 +1,51 @@
+package cluster
+
+import (
+	"sync"
+)
+
+// An in-process backplane, for running several nodes in one process (tests)
+// or a single node without any external dependency.
+type MemoryHub struct {
+	handlers []Handler
+	lock     sync.Mutex
+}
+
+func NewMemoryHub() *MemoryHub {
+	return new(MemoryHub)
+}
+
+// Make a backplane for one node joining the hub
+func (this *MemoryHub) Backplane() Backplane {
+	return &memoryBackplane{hub: this}
+}
+
+func (this *MemoryHub) deliver(msg *Message) {
+	this.lock.Lock()
+	handlers := append([]Handler{}, this.handlers...)
+	this.lock.Unlock()
+
+	for _, handler := range handlers {
+		copied := *msg
+		handler(&copied)
+	}
+}
+
+type memoryBackplane struct {
+	hub *MemoryHub
+}
+
+func (this *memoryBackplane) Publish(msg *Message) error {
+	this.hub.deliver(msg)
+	return nil
+}
+
+func (this *memoryBackplane) Subscribe(handler Handler) {
+	this.hub.lock.Lock()
+	defer this.hub.lock.Unlock()
+	this.hub.handlers = append(this.hub.handlers, handler)
+}
+
+func (this *memoryBackplane) Close() error {
+	return nil
+}
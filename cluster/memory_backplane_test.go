@@ -0,0 +1,28 @@
+package cluster
+
+import (
+	"testing"
+)
+
+func TestMemoryHubDeliversToEveryNode(t *testing.T) {
+	hub := NewMemoryHub()
+	a, b := hub.Backplane(), hub.Backplane()
+
+	var gotA, gotB []*Message
+	a.Subscribe(func(msg *Message) { gotA = append(gotA, msg) })
+	b.Subscribe(func(msg *Message) { gotB = append(gotB, msg) })
+
+	msg := &Message{Kind: KIND_ONLINE, NodeId: "a", UserId: "u1"}
+	if err := a.Publish(msg); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(gotA) != 1 || len(gotB) != 1 {
+		t.Fatalf("expected the message on both nodes, got %d and %d", len(gotA), len(gotB))
+	}
+	// Each handler gets its own copy
+	gotB[0].To = "changed"
+	if gotA[0].To != "" || msg.To != "" {
+		t.Fatal("expected the handlers not to share the message")
+	}
+}
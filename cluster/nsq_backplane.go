@@ -0,0 +1,76 @@
+package cluster
+
+import (
+	"encoding/json"
+	"github.com/bitly/go-nsq"
+	"github.com/theplant/qortex/utils"
+	"sync"
+)
+
+// A backplane on top of nsq: every node publishes to the same topic and
+// reads it with its own ephemeral channel, so each node gets every message.
+type NsqBackplane struct {
+	topic    string
+	writer   *nsq.Writer
+	reader   *nsq.Reader
+	handlers []Handler
+	lock     sync.Mutex
+}
+
+func NewNsqBackplane(nsqdAddr, topic, nodeId string, lookupdAddrs []string) (bp *NsqBackplane, err error) {
+	bp = &NsqBackplane{
+		topic:  topic,
+		writer: nsq.NewWriter(nsqdAddr),
+	}
+
+	bp.reader, err = nsq.NewReader(topic, "node-"+nodeId+"#ephemeral")
+	if err != nil {
+		return
+	}
+	bp.reader.AddHandler(bp)
+
+	for _, addr := range lookupdAddrs {
+		if err = bp.reader.ConnectToLookupd(addr); err != nil {
+			return
+		}
+	}
+	return
+}
+
+func (this *NsqBackplane) Publish(msg *Message) (err error) {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	_, _, err = this.writer.Publish(this.topic, body)
+	return
+}
+
+func (this *NsqBackplane) Subscribe(handler Handler) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.handlers = append(this.handlers, handler)
+}
+
+func (this *NsqBackplane) HandleMessage(m *nsq.Message) (err error) {
+	msg := new(Message)
+	if err = json.Unmarshal(m.Body, msg); err != nil {
+		utils.PrintStackAndError(err)
+		return
+	}
+
+	this.lock.Lock()
+	handlers := append([]Handler{}, this.handlers...)
+	this.lock.Unlock()
+
+	for _, handler := range handlers {
+		handler(msg)
+	}
+	return
+}
+
+func (this *NsqBackplane) Close() error {
+	this.reader.Stop()
+	this.writer.Stop()
+	return nil
+}
@@ -0,0 +1,188 @@
+package cluster
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Where a user is connected
+type Location struct {
+	NodeId string
+	OrgId  string
+}
+
+// What a node tells about its user, e.g. active/idle
+type Status struct {
+	State        string
+	LastActiveAt time.Time
+}
+
+// A location whose entry expired, e.g. its node died without an offline message
+type ExpiredEntry struct {
+	UserId string
+	Location
+	Status
+}
+
+type presenceEntry struct {
+	Status
+	expires time.Time
+}
+
+// The cluster wide view of who is online on which node. Nodes keep
+// announcing their users, an entry expires if it is not refreshed within ttl.
+// The nodes themselves expire the same way, see TouchNode.
+type Presence struct {
+	ttl     time.Duration
+	entries map[string]map[Location]*presenceEntry
+	nodes   map[string]time.Time
+	lock    sync.Mutex
+}
+
+func NewPresence(ttl time.Duration) *Presence {
+	return &Presence{
+		ttl:     ttl,
+		entries: make(map[string]map[Location]*presenceEntry),
+		nodes:   make(map[string]time.Time),
+	}
+}
+
+// The node is alive, with or without users
+func (this *Presence) TouchNode(nodeId string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.nodes[nodeId] = time.Now().Add(this.ttl)
+}
+
+// The living nodes, sorted
+func (this *Presence) Nodes() (nodeIds []string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	now := time.Now()
+	for nodeId, expires := range this.nodes {
+		if now.Before(expires) {
+			nodeIds = append(nodeIds, nodeId)
+		}
+	}
+	sort.Strings(nodeIds)
+	return
+}
+
+// Delete the expired entries and nodes, returning the entries
+func (this *Presence) Expire() (expired []ExpiredEntry) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	now := time.Now()
+	for userId, locs := range this.entries {
+		for loc, entry := range locs {
+			if now.After(entry.expires) {
+				delete(locs, loc)
+				expired = append(expired, ExpiredEntry{UserId: userId, Location: loc, Status: entry.Status})
+			}
+		}
+		if len(locs) == 0 {
+			delete(this.entries, userId)
+		}
+	}
+	for nodeId, expires := range this.nodes {
+		if now.After(expires) {
+			delete(this.nodes, nodeId)
+		}
+	}
+	return
+}
+
+func (this *Presence) Touch(userId string, loc Location, status Status) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	locs := this.entries[userId]
+	if locs == nil {
+		locs = make(map[Location]*presenceEntry)
+		this.entries[userId] = locs
+	}
+	locs[loc] = &presenceEntry{Status: status, expires: time.Now().Add(this.ttl)}
+}
+
+func (this *Presence) Remove(userId string, loc Location) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if locs := this.entries[userId]; locs != nil {
+		delete(locs, loc)
+		if len(locs) == 0 {
+			delete(this.entries, userId)
+		}
+	}
+}
+
+// Forget everything about a node, e.g. it is shut down
+func (this *Presence) RemoveNode(nodeId string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	delete(this.nodes, nodeId)
+	for userId, locs := range this.entries {
+		for loc := range locs {
+			if loc.NodeId == nodeId {
+				delete(locs, loc)
+			}
+		}
+		if len(locs) == 0 {
+			delete(this.entries, userId)
+		}
+	}
+}
+
+// The living locations of the user. The expired ones are left to Expire,
+// which tells they are gone.
+func (this *Presence) Locate(userId string) (locs []Location) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	now := time.Now()
+	for loc, entry := range this.entries[userId] {
+		if now.Before(entry.expires) {
+			locs = append(locs, loc)
+		}
+	}
+	return
+}
+
+// The statuses of the user in the organization, one per node
+func (this *Presence) Statuses(orgId, userId string) (statuses []Status) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	now := time.Now()
+	for loc, entry := range this.entries[userId] {
+		if loc.OrgId == orgId && now.Before(entry.expires) {
+			statuses = append(statuses, entry.Status)
+		}
+	}
+	return
+}
+
+// The users online in the organization on any node, with their statuses
+func (this *Presence) OrgUsers(orgId string) (users map[string][]Status) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	users = make(map[string][]Status)
+	now := time.Now()
+	for userId, locs := range this.entries {
+		for loc, entry := range locs {
+			if loc.OrgId == orgId && now.Before(entry.expires) {
+				users[userId] = append(users[userId], entry.Status)
+			}
+		}
+	}
+	return
+}
+
+func (this *Presence) IsOnlineIn(orgId, userId string) bool {
+	return len(this.Statuses(orgId, userId)) > 0
+}
@@ -0,0 +1,82 @@
+package cluster
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPresenceLocations(t *testing.T) {
+	p := NewPresence(time.Minute)
+	a1, b1, a2 := Location{"a", "org1"}, Location{"b", "org1"}, Location{"a", "org2"}
+
+	p.Touch("u1", a1, Status{State: "active"})
+	p.Touch("u1", b1, Status{State: "idle"})
+	p.Touch("u1", a2, Status{State: "idle"})
+	p.Touch("u2", b1, Status{State: "active"})
+
+	if locs := p.Locate("u1"); len(locs) != 3 {
+		t.Fatalf("expected 3 locations, got %v", locs)
+	}
+	if statuses := p.Statuses("org1", "u1"); len(statuses) != 2 {
+		t.Fatalf("expected 2 statuses in org1, got %v", statuses)
+	}
+	if users := p.OrgUsers("org2"); len(users) != 1 || len(users["u1"]) != 1 {
+		t.Fatalf("expected u1 only in org2, got %v", users)
+	}
+
+	p.Remove("u1", a2)
+	if p.IsOnlineIn("org2", "u1") {
+		t.Fatal("expected u1 gone from org2")
+	}
+
+	p.RemoveNode("b")
+	if locs := p.Locate("u1"); !reflect.DeepEqual(locs, []Location{a1}) {
+		t.Fatalf("expected u1 left on node a, got %v", locs)
+	}
+	if p.IsOnlineIn("org1", "u2") {
+		t.Fatal("expected u2 gone with node b")
+	}
+}
+
+func TestPresenceExpire(t *testing.T) {
+	p := NewPresence(20 * time.Millisecond)
+	a, b := Location{"a", "org"}, Location{"b", "org"}
+	lastActiveAt := time.Now()
+
+	p.Touch("u1", a, Status{State: "active", LastActiveAt: lastActiveAt})
+	p.TouchNode("a")
+	time.Sleep(30 * time.Millisecond)
+
+	p.Touch("u2", b, Status{State: "idle"})
+	p.TouchNode("b")
+
+	// Expired but not swept yet, it is not located any more
+	if locs := p.Locate("u1"); len(locs) != 0 {
+		t.Fatalf("expected u1 expired, got %v", locs)
+	}
+
+	expired := p.Expire()
+	want := []ExpiredEntry{{UserId: "u1", Location: a, Status: Status{State: "active", LastActiveAt: lastActiveAt}}}
+	if !reflect.DeepEqual(expired, want) {
+		t.Fatalf("expected %+v, got %+v", want, expired)
+	}
+	if expired = p.Expire(); len(expired) != 0 {
+		t.Fatalf("expected the expired entries told once, got %+v", expired)
+	}
+	if nodes := p.Nodes(); !reflect.DeepEqual(nodes, []string{"b"}) {
+		t.Fatalf("expected only node b alive, got %v", nodes)
+	}
+}
+
+func TestPresenceNodesSorted(t *testing.T) {
+	p := NewPresence(time.Minute)
+	for _, nodeId := range []string{"c", "a", "b"} {
+		p.TouchNode(nodeId)
+	}
+	p.RemoveNode("b")
+
+	if nodes := p.Nodes(); !reflect.DeepEqual(nodes, []string{"a", "c"}) {
+		t.Fatalf("expected [a c], got %v", nodes)
+	}
+}
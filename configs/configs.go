@@ -1,14 +1,626 @@
 package configs
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
 	"time"
 )
 
-var (
-	WSPort         = ":5055"
-	NsqLookupAdddr = "localhost:4161"
+const (
+	ENV_PREFIX = "QORTEX_RT_"
 )
 
-var (
-	ONLINE_USER_CLOSE_DURATION = 10 * time.Second
+var nodeIdInvalidChars = regexp.MustCompile(`[^.a-zA-Z0-9_-]+`)
+
+const (
+	ENV_DEVELOPMENT = "development"
+	ENV_PRODUCTION  = "production"
+)
+
+// Backplanes for the cluster mode
+const (
+	BACKPLANE_NONE = ""
+	BACKPLANE_NSQ  = "nsq"
+
+	// In process, a single node running the cluster code, for the development
+	BACKPLANE_MEMORY = "memory"
+)
+
+// Where the new message ids of the users are kept
+const (
+	STORE_MONGO  = "mongo"
+	STORE_MEMORY = "memory"
+)
+
+// Mailers of the notification mails to the offline users
+const (
+	MAILER_NONE   = ""
+	MAILER_SMTP   = "smtp"
+	MAILER_FILE   = "file"
+	MAILER_MEMORY = "memory"
+)
+
+// What to do when a push comes in and the user's push queue is already full.
+// The RPC responses are never dropped, the client waits for them.
+const (
+	OVERFLOW_DROP_OLDEST      = "drop_oldest"
+	OVERFLOW_COALESCE_REFRESH = "coalesce_refresh"
+	OVERFLOW_DISCONNECT       = "disconnect"
 )
+
+// Duration wraps time.Duration so it can be written as "10s" in the config file
+type Duration struct {
+	time.Duration
+}
+
+func (this Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(this.String())
+}
+
+func (this *Duration) UnmarshalJSON(data []byte) (err error) {
+	var s string
+	if err = json.Unmarshal(data, &s); err != nil {
+		return
+	}
+	this.Duration, err = time.ParseDuration(s)
+	return
+}
+
+// All the settings of the realtime server. It is built once in main.go
+// and handed to the services, models/ws and consumers packages.
+type Config struct {
+	Env    string
+	WSPort string
+
+	// The expvar counters are served on /debug/vars of it, e.g. "127.0.0.1:5056".
+	// Keep it off the public network, disabled if empty.
+	MetricsAddr string
+
+	NsqLookupdAddrs         []string
+	OnlineUserCloseDuration Duration
+	SendBufferSize          int
+	OverflowPolicy          string
+	RefreshCoalesceWindow   Duration
+	WriteTimeout            Duration
+	RpcTimeout              Duration
+	MaxRpcPerConnection     int
+	MaxRpcBatchSize         int
+	HeartbeatInterval       Duration
+	IdleTimeout             Duration
+	ShutdownTimeout         Duration
+	BusyRetryAfter          Duration
+
+	// The latest pushes kept per user for the reconnecting clients
+	ReplayBufferSize int
+
+	// One of the STORE_* values, the ids expire after NewMessageTTL
+	NewMessageStore string
+	NewMessageTTL   Duration
+
+	// A typing user is pushed at most once per TypingThrottle,
+	// and stops typing without Typing.Start for TypingTimeout
+	TypingThrottle Duration
+	TypingTimeout  Duration
+
+	// Origins allowed to open /conn with the cookie, e.g. "https://*.qortex.com"
+	AllowedOrigins []string
+
+	// Connect tickets and bearer tokens signed by the main app, SESSION_SECRET
+	// of qortex if empty. The used tickets are kept in TicketStore, one of the
+	// STORE_* values, it must be shared (mongo) in cluster mode.
+	TicketSecret string
+	TicketMaxAge Duration
+	TicketStore  string
+	TokenMaxAge  Duration
+
+	// Take the bearer token from the access_token query too, where it ends up in the logs
+	AllowTokenQuery bool
+
+	// Cluster mode, enabled when Backplane is not empty
+	NodeId         string
+	Backplane      string
+	NsqdAddr       string
+	BackplaneTopic string
+	PresenceTTL    Duration
+
+	// The users going offline are published to it (through NsqdAddr) for the
+	// digest mails, disabled if empty. A queued user is cancelled when coming
+	// back within OfflineQueueTTL.
+	OfflineTopic    string
+	OfflineQueueTTL Duration
+
+	// Notification mails to the offline users, disabled if Mailer is empty.
+	// A user gets at most one mail per MailThrottle.
+	Mailer        string
+	SmtpAddr      string
+	SmtpUser      string
+	SmtpPassword  string
+	SmtpTimeout   Duration
+	MailFrom      string
+	MailDir       string
+	MailThrottle  Duration
+	MailQueueSize int
+}
+
+func Default() *Config {
+	return &Config{
+		Env:                     ENV_DEVELOPMENT,
+		WSPort:                  ":5055",
+		NsqLookupdAddrs:         []string{"localhost:4161"},
+		OnlineUserCloseDuration: Duration{10 * time.Second},
+		SendBufferSize:          32,
+		OverflowPolicy:          OVERFLOW_COALESCE_REFRESH,
+		RefreshCoalesceWindow:   Duration{500 * time.Millisecond},
+		WriteTimeout:            Duration{10 * time.Second},
+		RpcTimeout:              Duration{10 * time.Second},
+		MaxRpcPerConnection:     8,
+		MaxRpcBatchSize:         20,
+		HeartbeatInterval:       Duration{25 * time.Second},
+		IdleTimeout:             Duration{60 * time.Second},
+		ShutdownTimeout:         Duration{15 * time.Second},
+		BusyRetryAfter:          Duration{5 * time.Second},
+		ReplayBufferSize:        100,
+		NewMessageStore:         STORE_MONGO,
+		NewMessageTTL:           Duration{7 * 24 * time.Hour},
+		TypingThrottle:          Duration{3 * time.Second},
+		TypingTimeout:           Duration{6 * time.Second},
+		TicketMaxAge:            Duration{time.Minute},
+		TicketStore:             STORE_MONGO,
+		TokenMaxAge:             Duration{time.Hour},
+		BackplaneTopic:          "realtime_backplane",
+		PresenceTTL:             Duration{30 * time.Second},
+		OfflineQueueTTL:         Duration{24 * time.Hour},
+		SmtpTimeout:             Duration{10 * time.Second},
+		MailThrottle:            Duration{10 * time.Minute},
+		MailQueueSize:           100,
+	}
+}
+
+// Load builds the config from the defaults, then the file (if any),
+// then the QORTEX_RT_* environment variables.
+func Load(path string) (cfg *Config, err error) {
+	cfg = Default()
+
+	if path != "" {
+		var data []byte
+		if data, err = ioutil.ReadFile(path); err != nil {
+			return
+		}
+		if err = parseFile(path, data, cfg); err != nil {
+			err = fmt.Errorf("Parse config file %s: %s", path, err)
+			return
+		}
+	}
+
+	err = cfg.ApplyEnv()
+	return
+}
+
+// The format goes by the extension: .toml, .yaml/.yml, otherwise json.
+// The toml and yaml settings are read the json way, so the keys match the
+// field names in any case and the durations are written like "10s" everywhere.
+func parseFile(path string, data []byte, cfg *Config) (err error) {
+	var settings map[string]interface{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		_, err = toml.Decode(string(data), &settings)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(data, &settings)
+	default:
+		return json.Unmarshal(data, cfg)
+	}
+	if err != nil {
+		return
+	}
+
+	if data, err = json.Marshal(settings); err != nil {
+		return
+	}
+	return json.Unmarshal(data, cfg)
+}
+
+func (this *Config) ApplyEnv() (err error) {
+	if v := getEnv("ENV"); v != "" {
+		this.Env = v
+	}
+
+	if v := getEnv("WS_PORT"); v != "" {
+		this.WSPort = v
+	}
+
+	if v := getEnv("METRICS_ADDR"); v != "" {
+		this.MetricsAddr = v
+	}
+
+	if v := getEnv("NSQLOOKUPD_ADDRS"); v != "" {
+		this.NsqLookupdAddrs = SplitList(v)
+	}
+
+	if v := getEnv("ONLINE_USER_CLOSE_DURATION"); v != "" {
+		if this.OnlineUserCloseDuration.Duration, err = time.ParseDuration(v); err != nil {
+			return
+		}
+	}
+
+	if v := getEnv("SEND_BUFFER_SIZE"); v != "" {
+		if this.SendBufferSize, err = strconv.Atoi(v); err != nil {
+			return
+		}
+	}
+
+	if v := getEnv("OVERFLOW_POLICY"); v != "" {
+		this.OverflowPolicy = v
+	}
+
+	if v := getEnv("REFRESH_COALESCE_WINDOW"); v != "" {
+		if this.RefreshCoalesceWindow.Duration, err = time.ParseDuration(v); err != nil {
+			return
+		}
+	}
+
+	if v := getEnv("WRITE_TIMEOUT"); v != "" {
+		if this.WriteTimeout.Duration, err = time.ParseDuration(v); err != nil {
+			return
+		}
+	}
+
+	if v := getEnv("RPC_TIMEOUT"); v != "" {
+		if this.RpcTimeout.Duration, err = time.ParseDuration(v); err != nil {
+			return
+		}
+	}
+
+	if v := getEnv("MAX_RPC_PER_CONNECTION"); v != "" {
+		if this.MaxRpcPerConnection, err = strconv.Atoi(v); err != nil {
+			return
+		}
+	}
+
+	if v := getEnv("MAX_RPC_BATCH_SIZE"); v != "" {
+		if this.MaxRpcBatchSize, err = strconv.Atoi(v); err != nil {
+			return
+		}
+	}
+
+	if v := getEnv("HEARTBEAT_INTERVAL"); v != "" {
+		if this.HeartbeatInterval.Duration, err = time.ParseDuration(v); err != nil {
+			return
+		}
+	}
+
+	if v := getEnv("IDLE_TIMEOUT"); v != "" {
+		if this.IdleTimeout.Duration, err = time.ParseDuration(v); err != nil {
+			return
+		}
+	}
+
+	if v := getEnv("SHUTDOWN_TIMEOUT"); v != "" {
+		if this.ShutdownTimeout.Duration, err = time.ParseDuration(v); err != nil {
+			return
+		}
+	}
+
+	if v := getEnv("BUSY_RETRY_AFTER"); v != "" {
+		if this.BusyRetryAfter.Duration, err = time.ParseDuration(v); err != nil {
+			return
+		}
+	}
+
+	if v := getEnv("REPLAY_BUFFER_SIZE"); v != "" {
+		if this.ReplayBufferSize, err = strconv.Atoi(v); err != nil {
+			return
+		}
+	}
+
+	if v := getEnv("NEW_MESSAGE_STORE"); v != "" {
+		this.NewMessageStore = v
+	}
+
+	if v := getEnv("NEW_MESSAGE_TTL"); v != "" {
+		if this.NewMessageTTL.Duration, err = time.ParseDuration(v); err != nil {
+			return
+		}
+	}
+
+	if v := getEnv("TYPING_THROTTLE"); v != "" {
+		if this.TypingThrottle.Duration, err = time.ParseDuration(v); err != nil {
+			return
+		}
+	}
+
+	if v := getEnv("TYPING_TIMEOUT"); v != "" {
+		if this.TypingTimeout.Duration, err = time.ParseDuration(v); err != nil {
+			return
+		}
+	}
+
+	if v := getEnv("ALLOWED_ORIGINS"); v != "" {
+		this.AllowedOrigins = SplitList(v)
+	}
+
+	if v := getEnv("TICKET_SECRET"); v != "" {
+		this.TicketSecret = v
+	}
+
+	if v := getEnv("TICKET_MAX_AGE"); v != "" {
+		if this.TicketMaxAge.Duration, err = time.ParseDuration(v); err != nil {
+			return
+		}
+	}
+
+	if v := getEnv("TICKET_STORE"); v != "" {
+		this.TicketStore = v
+	}
+
+	if v := getEnv("TOKEN_MAX_AGE"); v != "" {
+		if this.TokenMaxAge.Duration, err = time.ParseDuration(v); err != nil {
+			return
+		}
+	}
+
+	if v := getEnv("ALLOW_TOKEN_QUERY"); v != "" {
+		if this.AllowTokenQuery, err = strconv.ParseBool(v); err != nil {
+			return
+		}
+	}
+
+	if v := getEnv("NODE_ID"); v != "" {
+		this.NodeId = v
+	}
+
+	if v := getEnv("BACKPLANE"); v != "" {
+		this.Backplane = v
+	}
+
+	if v := getEnv("NSQD_ADDR"); v != "" {
+		this.NsqdAddr = v
+	}
+
+	if v := getEnv("BACKPLANE_TOPIC"); v != "" {
+		this.BackplaneTopic = v
+	}
+
+	if v := getEnv("PRESENCE_TTL"); v != "" {
+		if this.PresenceTTL.Duration, err = time.ParseDuration(v); err != nil {
+			return
+		}
+	}
+
+	if v := getEnv("OFFLINE_TOPIC"); v != "" {
+		this.OfflineTopic = v
+	}
+
+	if v := getEnv("OFFLINE_QUEUE_TTL"); v != "" {
+		if this.OfflineQueueTTL.Duration, err = time.ParseDuration(v); err != nil {
+			return
+		}
+	}
+
+	if v := getEnv("MAILER"); v != "" {
+		this.Mailer = v
+	}
+
+	if v := getEnv("SMTP_ADDR"); v != "" {
+		this.SmtpAddr = v
+	}
+
+	if v := getEnv("SMTP_USER"); v != "" {
+		this.SmtpUser = v
+	}
+
+	if v := getEnv("SMTP_PASSWORD"); v != "" {
+		this.SmtpPassword = v
+	}
+
+	if v := getEnv("SMTP_TIMEOUT"); v != "" {
+		if this.SmtpTimeout.Duration, err = time.ParseDuration(v); err != nil {
+			return
+		}
+	}
+
+	if v := getEnv("MAIL_FROM"); v != "" {
+		this.MailFrom = v
+	}
+
+	if v := getEnv("MAIL_DIR"); v != "" {
+		this.MailDir = v
+	}
+
+	if v := getEnv("MAIL_THROTTLE"); v != "" {
+		if this.MailThrottle.Duration, err = time.ParseDuration(v); err != nil {
+			return
+		}
+	}
+
+	if v := getEnv("MAIL_QUEUE_SIZE"); v != "" {
+		if this.MailQueueSize, err = strconv.Atoi(v); err != nil {
+			return
+		}
+	}
+
+	return
+}
+
+// Hostname plus the port, e.g. "web1-5055". NodeId is part of nsq channel
+// names, so only [.a-zA-Z0-9_-] are kept.
+func DefaultNodeId(wsPort string) string {
+	host, _ := os.Hostname()
+	return strings.Trim(nodeIdInvalidChars.ReplaceAllString(host+"-"+strings.TrimLeft(wsPort, ":"), "-"), "-")
+}
+
+func (this *Config) ClusterMode() bool {
+	return this.Backplane != BACKPLANE_NONE
+}
+
+func (this *Config) Validate() error {
+	switch this.Env {
+	case ENV_DEVELOPMENT:
+	case ENV_PRODUCTION:
+		if len(this.AllowedOrigins) == 0 {
+			return errors.New("AllowedOrigins is required in production, e.g. QORTEX_RT_ALLOWED_ORIGINS=https://*.qortex.com")
+		}
+	default:
+		return fmt.Errorf("Unknown Env %q", this.Env)
+	}
+	for _, origin := range this.AllowedOrigins {
+		if !strings.Contains(origin, "://") {
+			return fmt.Errorf("AllowedOrigins %q should be like https://example.com", origin)
+		}
+	}
+	if this.WSPort == "" {
+		return errors.New("WSPort is required")
+	}
+	if this.MetricsAddr != "" && this.MetricsAddr == this.WSPort {
+		return errors.New("MetricsAddr should be another address than WSPort")
+	}
+	if len(this.NsqLookupdAddrs) == 0 {
+		return errors.New("At least one nsqlookupd address is required")
+	}
+	for _, addr := range this.NsqLookupdAddrs {
+		if addr == "" {
+			return errors.New("Empty nsqlookupd address")
+		}
+	}
+	if this.OnlineUserCloseDuration.Duration < 0 {
+		return errors.New("OnlineUserCloseDuration can't be negative")
+	}
+	if this.SendBufferSize <= 0 {
+		return errors.New("SendBufferSize should be greater than 0")
+	}
+	switch this.OverflowPolicy {
+	case OVERFLOW_DROP_OLDEST, OVERFLOW_COALESCE_REFRESH, OVERFLOW_DISCONNECT:
+	default:
+		return fmt.Errorf("Unknown OverflowPolicy %q", this.OverflowPolicy)
+	}
+	if this.RefreshCoalesceWindow.Duration < 0 {
+		return errors.New("RefreshCoalesceWindow can't be negative")
+	}
+	if this.WriteTimeout.Duration <= 0 {
+		return errors.New("WriteTimeout should be greater than 0")
+	}
+	if this.RpcTimeout.Duration <= 0 {
+		return errors.New("RpcTimeout should be greater than 0")
+	}
+	if this.MaxRpcPerConnection <= 0 {
+		return errors.New("MaxRpcPerConnection should be greater than 0")
+	}
+	if this.MaxRpcBatchSize <= 0 {
+		return errors.New("MaxRpcBatchSize should be greater than 0")
+	}
+	if this.HeartbeatInterval.Duration <= 0 {
+		return errors.New("HeartbeatInterval should be greater than 0")
+	}
+	if this.IdleTimeout.Duration <= this.HeartbeatInterval.Duration {
+		return errors.New("IdleTimeout should be greater than HeartbeatInterval")
+	}
+	if this.ShutdownTimeout.Duration <= 0 {
+		return errors.New("ShutdownTimeout should be greater than 0")
+	}
+	if this.BusyRetryAfter.Duration < time.Second {
+		return errors.New("BusyRetryAfter should be at least 1s")
+	}
+	if this.ReplayBufferSize < 0 {
+		return errors.New("ReplayBufferSize can't be negative")
+	}
+	switch this.NewMessageStore {
+	case STORE_MONGO, STORE_MEMORY:
+	default:
+		return fmt.Errorf("Unknown NewMessageStore %q", this.NewMessageStore)
+	}
+	if this.NewMessageTTL.Duration <= 0 {
+		return errors.New("NewMessageTTL should be greater than 0")
+	}
+	if this.TypingThrottle.Duration < 0 {
+		return errors.New("TypingThrottle can't be negative")
+	}
+	if this.TypingTimeout.Duration <= this.TypingThrottle.Duration {
+		return errors.New("TypingTimeout should be greater than TypingThrottle")
+	}
+	if this.NodeId != "" && nodeIdInvalidChars.MatchString(this.NodeId) {
+		return fmt.Errorf("NodeId %q can only have [.a-zA-Z0-9_-]", this.NodeId)
+	}
+	if this.TicketMaxAge.Duration <= 0 {
+		return errors.New("TicketMaxAge should be greater than 0")
+	}
+	if this.TokenMaxAge.Duration <= 0 {
+		return errors.New("TokenMaxAge should be greater than 0")
+	}
+	switch this.TicketStore {
+	case STORE_MONGO:
+	case STORE_MEMORY:
+		if this.ClusterMode() {
+			return errors.New("TicketStore should be mongo in cluster mode, so a ticket is used once across the nodes")
+		}
+	default:
+		return fmt.Errorf("Unknown TicketStore %q", this.TicketStore)
+	}
+	if this.ClusterMode() {
+		if this.Backplane != BACKPLANE_NSQ && this.Backplane != BACKPLANE_MEMORY {
+			return fmt.Errorf("Unknown Backplane %q", this.Backplane)
+		}
+		if this.NodeId == "" {
+			return errors.New("NodeId is required in cluster mode")
+		}
+		if this.Backplane == BACKPLANE_NSQ && this.NsqdAddr == "" {
+			return errors.New("NsqdAddr is required for the nsq backplane")
+		}
+		if this.Backplane == BACKPLANE_NSQ && this.BackplaneTopic == "" {
+			return errors.New("BackplaneTopic is required for the nsq backplane")
+		}
+		if this.PresenceTTL.Duration <= 0 {
+			return errors.New("PresenceTTL should be greater than 0")
+		}
+	}
+	if this.OfflineTopic != "" && this.NsqdAddr == "" {
+		return errors.New("NsqdAddr is required for the OfflineTopic")
+	}
+	if this.OfflineQueueTTL.Duration <= 0 {
+		return errors.New("OfflineQueueTTL should be greater than 0")
+	}
+	switch this.Mailer {
+	case MAILER_NONE, MAILER_MEMORY:
+	case MAILER_SMTP:
+		if this.SmtpAddr == "" || this.MailFrom == "" {
+			return errors.New("SmtpAddr and MailFrom are required for the smtp mailer")
+		}
+		if this.SmtpTimeout.Duration <= 0 {
+			return errors.New("SmtpTimeout should be greater than 0")
+		}
+		if this.MailQueueSize <= 0 {
+			return errors.New("MailQueueSize should be greater than 0")
+		}
+	case MAILER_FILE:
+		if this.MailDir == "" {
+			return errors.New("MailDir is required for the file mailer")
+		}
+	default:
+		return fmt.Errorf("Unknown Mailer %q", this.Mailer)
+	}
+	if this.MailThrottle.Duration < 0 {
+		return errors.New("MailThrottle can't be negative")
+	}
+	return nil
+}
+
+// Split a comma separated list, ignoring the blank items
+func SplitList(s string) (list []string) {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return
+}
+
+func getEnv(key string) string {
+	return strings.TrimSpace(os.Getenv(ENV_PREFIX + key))
+}
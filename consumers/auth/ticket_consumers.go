@@ -0,0 +1,45 @@
+package auth
+
+import (
+	"encoding/json"
+	"github.com/bitly/go-nsq"
+	"github.com/kobeld/qortex-realtime/services"
+	"github.com/theplant/qortex/utils"
+)
+
+const (
+	TICKET_REVOKED_TOPIC_NAME = "connect_ticket_revoked"
+)
+
+// Published by the main app, with either TicketId or MemberId
+type TicketRevokedData struct {
+	TicketId string
+	MemberId string
+}
+
+// Every node has to know the revoked tickets, so each one reads with its own channel
+type TicketRevokedConsumer struct {
+	NodeId string
+}
+
+func (this *TicketRevokedConsumer) TopicAndChannel() (topic, channel string) {
+	return TICKET_REVOKED_TOPIC_NAME, "realtime-" + this.NodeId + "#ephemeral"
+}
+
+func (this *TicketRevokedConsumer) HandleMessage(msg *nsq.Message) (err error) {
+
+	data := new(TicketRevokedData)
+	err = json.Unmarshal(msg.Body, data)
+	if err != nil {
+		utils.PrintStackAndError(err)
+		return
+	}
+
+	if data.TicketId != "" {
+		services.Tickets.Revoke(data.TicketId)
+	}
+	if data.MemberId != "" {
+		services.Tickets.RevokeMember(data.MemberId)
+	}
+	return
+}
@@ -1,10 +1,13 @@
 package consumers
 
 import (
+	"errors"
 	"github.com/bitly/go-nsq"
 	"github.com/kobeld/qortex-realtime/configs"
+	"github.com/kobeld/qortex-realtime/consumers/auth"
 	"github.com/kobeld/qortex-realtime/consumers/nfts"
 	"github.com/theplant/qortex/utils"
+	"time"
 )
 
 type Consumer interface {
@@ -12,11 +15,15 @@ type Consumer interface {
 	HandleMessage(*nsq.Message) error
 }
 
-func InitConsumers() (err error) {
+// The running readers, kept for stopping them on shutdown
+var readers []*nsq.Reader
+
+func InitConsumers(cfg *configs.Config) (err error) {
 
 	// Put consumers here
 	consumers := []Consumer{
 		&nfts.EntryNtfsConsumer{},
+		&auth.TicketRevokedConsumer{NodeId: cfg.NodeId},
 	}
 
 	for _, consumer := range consumers {
@@ -30,12 +37,35 @@ func InitConsumers() (err error) {
 
 		reader.AddHandler(consumer)
 
-		err = reader.ConnectToLookupd(configs.NsqLookupAdddr)
-		if err != nil {
-			utils.PrintStackAndError(err)
-			return err
+		for _, addr := range cfg.NsqLookupdAddrs {
+			err = reader.ConnectToLookupd(addr)
+			if err != nil {
+				utils.PrintStackAndError(err)
+				return err
+			}
+		}
+
+		readers = append(readers, reader)
+	}
+
+	return
+}
+
+// Stop all the readers and wait for the in-flight messages to be finished
+func StopConsumers(deadline time.Time) (err error) {
+	for _, reader := range readers {
+		reader.Stop()
+	}
+
+	for _, reader := range readers {
+		select {
+		case <-reader.ExitChan:
+		case <-time.After(deadline.Sub(time.Now())):
+			err = errors.New("Timeout on waiting the nsq readers to stop")
+			return
 		}
 	}
 
+	readers = nil
 	return
 }
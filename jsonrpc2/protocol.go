@@ -0,0 +1,137 @@
+package jsonrpc2
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+const (
+	VERSION = "2.0"
+)
+
+// The error codes defined by the JSON-RPC 2.0 spec
+const (
+	PARSE_ERROR      = -32700
+	INVALID_REQUEST  = -32600
+	METHOD_NOT_FOUND = -32601
+	INVALID_PARAMS   = -32602
+	INTERNAL_ERROR   = -32603
+)
+
+// A call from the client. Without Id it is a notification, expecting no response.
+// "id": null is still a call, it is responded with the null id.
+type Request struct {
+	Version string           `json:"jsonrpc"`
+	Method  string           `json:"method"`
+	Params  json.RawMessage  `json:"params,omitempty"`
+	Id      *json.RawMessage `json:"id,omitempty"`
+}
+
+func (this *Request) IsNotification() bool {
+	return this.Id == nil
+}
+
+// A null id would leave Id nil, it is kept as the raw null
+func (this *Request) UnmarshalJSON(data []byte) (err error) {
+	type plainRequest Request
+	if err = json.Unmarshal(data, (*plainRequest)(this)); err != nil {
+		return
+	}
+
+	var fields map[string]json.RawMessage
+	if err = json.Unmarshal(data, &fields); err != nil {
+		return
+	}
+	if id, ok := fields["id"]; ok {
+		this.Id = &id
+	}
+	return
+}
+
+// Split the message into its requests, one unless it is a batch.
+// The batches larger than maxBatch are invalid.
+func ParseMessage(data []byte, maxBatch int) (raws []json.RawMessage, isBatch bool, err *Error) {
+	data = bytes.TrimSpace(data)
+	if !json.Valid(data) {
+		err = NewError(PARSE_ERROR, "Parse error")
+		return
+	}
+
+	if data[0] != '[' {
+		raws = []json.RawMessage{data}
+		return
+	}
+
+	isBatch = true
+	if e := json.Unmarshal(data, &raws); e != nil || len(raws) == 0 {
+		raws, err = nil, NewError(INVALID_REQUEST, "Invalid batch")
+		return
+	}
+	if len(raws) > maxBatch {
+		raws, err = nil, NewError(INVALID_REQUEST, fmt.Sprintf("Batch of more than %d requests", maxBatch))
+	}
+	return
+}
+
+// Decode one request of the message. The id of an invalid one is kept when
+// it can be read, so the client can tell which request failed.
+func ParseRequest(raw json.RawMessage) (req *Request, err *Error) {
+	req = new(Request)
+	if e := json.Unmarshal(raw, req); e != nil {
+		req, err = nil, NewError(INVALID_REQUEST, "Invalid request")
+		return
+	}
+	if req.Version != VERSION || req.Method == "" {
+		err = NewError(INVALID_REQUEST, "Invalid request")
+	}
+	return
+}
+
+type Response struct {
+	Version string           `json:"jsonrpc"`
+	Result  *json.RawMessage `json:"result,omitempty"`
+	Error   *Error           `json:"error,omitempty"`
+	Id      *json.RawMessage `json:"id"`
+}
+
+// A server push, the method tells the client what it is.
+// Seq is our extension, set on the pushes the client can resume from.
+type Notification struct {
+	Version string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params,omitempty"`
+	Seq     uint64      `json:"seq,omitempty"`
+}
+
+func NewNotification(method string, params interface{}) *Notification {
+	return &Notification{Version: VERSION, Method: method, Params: params}
+}
+
+type Error struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+func NewError(code int, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+func (this *Error) Error() string {
+	return fmt.Sprintf("jsonrpc2 error %d: %s", this.Code, this.Message)
+}
+
+func NewResult(id *json.RawMessage, result interface{}) (resp *Response) {
+	data, err := json.Marshal(result)
+	if err != nil {
+		return NewErrorResponse(id, NewError(INTERNAL_ERROR, err.Error()))
+	}
+
+	raw := json.RawMessage(data)
+	return &Response{Version: VERSION, Result: &raw, Id: id}
+}
+
+func NewErrorResponse(id *json.RawMessage, err *Error) *Response {
+	return &Response{Version: VERSION, Error: err, Id: id}
+}
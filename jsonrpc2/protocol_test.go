@@ -0,0 +1,94 @@
+package jsonrpc2
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestParseMessage(t *testing.T) {
+	cases := []struct {
+		name    string
+		message string
+		count   int
+		isBatch bool
+		code    int
+	}{
+		{"request", `{"jsonrpc":"2.0","id":1,"method":"A.B"}`, 1, false, 0},
+		{"spaces around", " \n{\"jsonrpc\":\"2.0\",\"method\":\"A.B\"}\n", 1, false, 0},
+		{"batch", `[{"jsonrpc":"2.0","id":1,"method":"A.B"},{"jsonrpc":"2.0","method":"A.B"}]`, 2, true, 0},
+		{"batch of anything", `[1,2]`, 2, true, 0},
+		{"broken json", `{"jsonrpc":`, 0, false, PARSE_ERROR},
+		{"empty", ``, 0, false, PARSE_ERROR},
+		{"empty batch", `[]`, 0, true, INVALID_REQUEST},
+		{"too large batch", `[1,2,3]`, 0, true, INVALID_REQUEST},
+	}
+
+	for _, c := range cases {
+		raws, isBatch, err := ParseMessage([]byte(c.message), 2)
+		code := 0
+		if err != nil {
+			code = err.Code
+		}
+		if code != c.code || len(raws) != c.count || isBatch != c.isBatch {
+			t.Errorf("%s: expected %d requests batch %v code %d, got %d batch %v code %d",
+				c.name, c.count, c.isBatch, c.code, len(raws), isBatch, code)
+		}
+	}
+}
+
+func TestParseRequest(t *testing.T) {
+	cases := []struct {
+		name         string
+		raw          string
+		id           string
+		notification bool
+		code         int
+	}{
+		{"call", `{"jsonrpc":"2.0","id":1,"method":"A.B"}`, "1", false, 0},
+		{"string id", `{"jsonrpc":"2.0","id":"x","method":"A.B"}`, `"x"`, false, 0},
+		{"null id", `{"jsonrpc":"2.0","id":null,"method":"A.B"}`, "null", false, 0},
+		{"notification", `{"jsonrpc":"2.0","method":"A.B"}`, "", true, 0},
+		{"no version", `{"id":1,"method":"A.B"}`, "1", false, INVALID_REQUEST},
+		{"old version", `{"jsonrpc":"1.0","id":1,"method":"A.B"}`, "1", false, INVALID_REQUEST},
+		{"no method", `{"jsonrpc":"2.0","id":1}`, "1", false, INVALID_REQUEST},
+		{"not an object", `1`, "", false, INVALID_REQUEST},
+		{"wrong method type", `{"jsonrpc":"2.0","id":1,"method":1}`, "", false, INVALID_REQUEST},
+	}
+
+	for _, c := range cases {
+		req, err := ParseRequest(json.RawMessage(c.raw))
+		code := 0
+		if err != nil {
+			code = err.Code
+		}
+		if code != c.code {
+			t.Errorf("%s: expected code %d, got %d", c.name, c.code, code)
+			continue
+		}
+		if req == nil {
+			if c.id != "" {
+				t.Errorf("%s: expected the id %s kept", c.name, c.id)
+			}
+			continue
+		}
+
+		id := ""
+		if req.Id != nil {
+			id = string(*req.Id)
+		}
+		if id != c.id || req.IsNotification() != c.notification {
+			t.Errorf("%s: expected id %q notification %v, got %q %v", c.name, c.id, c.notification, id, req.IsNotification())
+		}
+	}
+}
+
+func TestResponseOfNullId(t *testing.T) {
+	req, _ := ParseRequest(json.RawMessage(`{"jsonrpc":"2.0","id":null,"method":"A.B"}`))
+	data, err := json.Marshal(NewResult(req.Id, 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != `{"jsonrpc":"2.0","result":1,"id":null}` {
+		t.Fatalf("unexpected response %s", data)
+	}
+}
@@ -0,0 +1,123 @@
+package jsonrpc2
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"sync"
+)
+
+var typeOfError = reflect.TypeOf((*error)(nil)).Elem()
+
+type method struct {
+	rcvr      reflect.Value
+	fn        reflect.Method
+	argsType  reflect.Type
+	replyType reflect.Type
+}
+
+// Dispatches the calls to the registered methods, which look like the
+// net/rpc ones: func (t *T) MethodName(args *A, reply *R) error
+type Router struct {
+	methods map[string]*method
+	lock    sync.RWMutex
+}
+
+func NewRouter() *Router {
+	return &Router{methods: make(map[string]*method)}
+}
+
+// Register the suitable methods of rcvr as "TypeName.MethodName"
+func (this *Router) Register(rcvr interface{}) error {
+	v := reflect.ValueOf(rcvr)
+	t := v.Type()
+	name := reflect.Indirect(v).Type().Name()
+	if name == "" {
+		return errors.New("jsonrpc2: can't register an unnamed type")
+	}
+
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	registered := 0
+	for i := 0; i < t.NumMethod(); i++ {
+		fn := t.Method(i)
+		ft := fn.Type
+		if fn.PkgPath != "" || ft.NumIn() != 3 || ft.NumOut() != 1 || ft.Out(0) != typeOfError {
+			continue
+		}
+		if ft.In(1).Kind() != reflect.Ptr || ft.In(2).Kind() != reflect.Ptr {
+			continue
+		}
+
+		this.methods[name+"."+fn.Name] = &method{
+			rcvr:      v,
+			fn:        fn,
+			argsType:  ft.In(1).Elem(),
+			replyType: ft.In(2).Elem(),
+		}
+		registered++
+	}
+
+	if registered == 0 {
+		return errors.New("jsonrpc2: type " + name + " has no suitable methods")
+	}
+	return nil
+}
+
+// Decode the params, let prepare look at the args (e.g. to hand them a context),
+// then call the method. The params can be an object or an array of one object.
+func (this *Router) Call(name string, params json.RawMessage, prepare func(args interface{}) error) (reply interface{}, err error) {
+	this.lock.RLock()
+	m, ok := this.methods[name]
+	this.lock.RUnlock()
+	if !ok {
+		err = NewError(METHOD_NOT_FOUND, "Method not found: "+name)
+		return
+	}
+
+	args := reflect.New(m.argsType)
+	if err = decodeParams(params, args.Interface()); err != nil {
+		err = NewError(INVALID_PARAMS, err.Error())
+		return
+	}
+
+	if prepare != nil {
+		if err = prepare(args.Interface()); err != nil {
+			return
+		}
+	}
+
+	replyv := reflect.New(m.replyType)
+	out := m.fn.Func.Call([]reflect.Value{m.rcvr, args, replyv})
+	if e := out[0].Interface(); e != nil {
+		err = e.(error)
+		return
+	}
+	reply = replyv.Interface()
+	return
+}
+
+func decodeParams(params json.RawMessage, args interface{}) error {
+	params = bytes.TrimSpace(params)
+	if len(params) == 0 || bytes.Equal(params, []byte("null")) {
+		return nil
+	}
+
+	if params[0] == '[' {
+		var list []json.RawMessage
+		if err := json.Unmarshal(params, &list); err != nil {
+			return err
+		}
+		switch len(list) {
+		case 0:
+			return nil
+		case 1:
+			return json.Unmarshal(list[0], args)
+		}
+		return errors.New("Expecting at most one param")
+	}
+
+	return json.Unmarshal(params, args)
+}
@@ -0,0 +1,145 @@
+package jsonrpc2
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+type Arith int
+
+type ArithArgs struct {
+	A, B int
+}
+
+func (this *Arith) Add(args *ArithArgs, reply *int) error {
+	*reply = args.A + args.B
+	return nil
+}
+
+func (this *Arith) Divide(args *ArithArgs, reply *int) error {
+	if args.B == 0 {
+		return NewError(INVALID_PARAMS, "Divided by zero")
+	}
+	*reply = args.A / args.B
+	return nil
+}
+
+// Not suitable: unexported, wrong arguments or results
+func (this *Arith) unexported(args *ArithArgs, reply *int) error { return nil }
+func (this *Arith) NoReply(args *ArithArgs) error                { return nil }
+func (this *Arith) ValueArgs(args ArithArgs, reply *int) error   { return nil }
+func (this *Arith) NoError(args *ArithArgs, reply *int)          {}
+
+type Unsuitable int
+
+func (this *Unsuitable) NoReply(args *ArithArgs) error { return nil }
+
+func TestRegister(t *testing.T) {
+	router := NewRouter()
+	if err := router.Register(new(Arith)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"Arith.Add", "Arith.Divide"} {
+		if _, ok := router.methods[name]; !ok {
+			t.Errorf("expected %s registered", name)
+		}
+	}
+	for _, name := range []string{"Arith.unexported", "Arith.NoReply", "Arith.ValueArgs", "Arith.NoError"} {
+		if _, ok := router.methods[name]; ok {
+			t.Errorf("expected %s not registered", name)
+		}
+	}
+
+	if err := router.Register(new(Unsuitable)); err == nil {
+		t.Error("expected an error for a type without suitable methods")
+	}
+	if err := router.Register(new(struct{ Arith })); err == nil {
+		t.Error("expected an error for an unnamed type")
+	}
+}
+
+func TestCall(t *testing.T) {
+	router := NewRouter()
+	router.Register(new(Arith))
+
+	cases := []struct {
+		name   string
+		method string
+		params string
+		reply  int
+		code   int
+	}{
+		{"object params", "Arith.Add", `{"A":1,"B":2}`, 3, 0},
+		{"array of one object", "Arith.Add", `[{"A":1,"B":2}]`, 3, 0},
+		{"method error", "Arith.Divide", `{"A":1,"B":0}`, 0, INVALID_PARAMS},
+		{"method not found", "Arith.Nope", `{}`, 0, METHOD_NOT_FOUND},
+		{"invalid params", "Arith.Add", `{"A":"1"}`, 0, INVALID_PARAMS},
+		{"too many params", "Arith.Add", `[{"A":1},{"B":2}]`, 0, INVALID_PARAMS},
+	}
+
+	for _, c := range cases {
+		reply, err := router.Call(c.method, json.RawMessage(c.params), nil)
+		if c.code != 0 {
+			if rpcErr, ok := err.(*Error); !ok || rpcErr.Code != c.code {
+				t.Errorf("%s: expected code %d, got %v", c.name, c.code, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", c.name, err)
+			continue
+		}
+		if *reply.(*int) != c.reply {
+			t.Errorf("%s: expected %d, got %d", c.name, c.reply, *reply.(*int))
+		}
+	}
+}
+
+func TestCallPrepare(t *testing.T) {
+	router := NewRouter()
+	router.Register(new(Arith))
+
+	reply, err := router.Call("Arith.Add", json.RawMessage(`{"A":1}`), func(args interface{}) error {
+		args.(*ArithArgs).B = 10
+		return nil
+	})
+	if err != nil || *reply.(*int) != 11 {
+		t.Fatalf("expected the args prepared, got %v %v", reply, err)
+	}
+
+	refused := NewError(INVALID_REQUEST, "Refused")
+	if _, err = router.Call("Arith.Add", nil, func(args interface{}) error { return refused }); err != refused {
+		t.Fatalf("expected the prepare error, got %v", err)
+	}
+}
+
+func TestDecodeParams(t *testing.T) {
+	cases := []struct {
+		name   string
+		params string
+		args   ArithArgs
+		err    bool
+	}{
+		{"missing", ``, ArithArgs{}, false},
+		{"null", `null`, ArithArgs{}, false},
+		{"object", `{"A":1,"B":2}`, ArithArgs{1, 2}, false},
+		{"empty array", `[]`, ArithArgs{}, false},
+		{"array of one object", ` [{"A":1}] `, ArithArgs{1, 0}, false},
+		{"array of two", `[{"A":1},{"B":2}]`, ArithArgs{}, true},
+		{"wrong type", `{"A":"1"}`, ArithArgs{}, true},
+		{"broken array", `[{"A":1}`, ArithArgs{}, true},
+	}
+
+	for _, c := range cases {
+		var args ArithArgs
+		err := decodeParams(json.RawMessage(c.params), &args)
+		if (err != nil) != c.err {
+			t.Errorf("%s: expected error %v, got %v", c.name, c.err, err)
+			continue
+		}
+		if !c.err && args != c.args {
+			t.Errorf("%s: expected %+v, got %+v", c.name, c.args, args)
+		}
+	}
+}
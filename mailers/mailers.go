@@ -0,0 +1,289 @@
+package mailers
+
+import (
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"github.com/kobeld/qortex-realtime/configs"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrQueueFull = errors.New("The mail queue is full")
+	ErrStopped   = errors.New("The mailer is stopped")
+)
+
+type Mail struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Sends the notification mails to the offline users
+type Mailer interface {
+	Send(mail *Mail) error
+}
+
+// A mailer sending in the background, stopped on shutdown
+type StoppableMailer interface {
+	Mailer
+	Stop(deadline time.Time) error
+}
+
+// The mailer of config.Mailer, nil if the mails are disabled.
+// The smtp mailer sends in the background through a bounded queue.
+func New(cfg *configs.Config) Mailer {
+	switch cfg.Mailer {
+	case configs.MAILER_SMTP:
+		smtpMailer := NewSmtpMailer(cfg.SmtpAddr, cfg.SmtpUser, cfg.SmtpPassword, cfg.MailFrom, cfg.SmtpTimeout.Duration)
+		return NewAsyncMailer(smtpMailer, cfg.MailQueueSize)
+	case configs.MAILER_FILE:
+		return NewFileMailer(cfg.MailDir, cfg.MailFrom)
+	case configs.MAILER_MEMORY:
+		return NewMemoryMailer()
+	}
+	return nil
+}
+
+type SmtpMailer struct {
+	addr      string
+	host      string
+	from      string
+	auth      smtp.Auth
+	timeout   time.Duration
+	tlsConfig *tls.Config
+}
+
+// Without user the server is used without authentication. A mail gives up
+// after the timeout, dialing included.
+func NewSmtpMailer(addr, user, password, from string, timeout time.Duration) *SmtpMailer {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+
+	mailer := &SmtpMailer{addr: addr, host: host, from: from, timeout: timeout}
+	mailer.tlsConfig = &tls.Config{ServerName: host}
+	if user != "" {
+		mailer.auth = smtp.PlainAuth("", user, password, host)
+	}
+	return mailer
+}
+
+// The connection is upgraded with STARTTLS when the server offers it, smtp.PlainAuth
+// refuses to send the password unencrypted to anything but localhost.
+func (this *SmtpMailer) Send(mail *Mail) (err error) {
+	msg, err := message(this.from, mail)
+	if err != nil {
+		return
+	}
+	from, err := plainAddress(this.from)
+	if err != nil {
+		return
+	}
+	to, err := plainAddress(mail.To)
+	if err != nil {
+		return
+	}
+
+	conn, err := net.DialTimeout("tcp", this.addr, this.timeout)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(this.timeout))
+
+	client, err := smtp.NewClient(conn, this.host)
+	if err != nil {
+		return
+	}
+	defer client.Close()
+
+	if ok, _ := client.Extension("STARTTLS"); ok {
+		if err = client.StartTLS(this.tlsConfig); err != nil {
+			return
+		}
+	}
+	if this.auth != nil {
+		if err = client.Auth(this.auth); err != nil {
+			return
+		}
+	}
+	if err = client.Mail(from); err != nil {
+		return
+	}
+	if err = client.Rcpt(to); err != nil {
+		return
+	}
+
+	w, err := client.Data()
+	if err != nil {
+		return
+	}
+	if _, err = w.Write(msg); err != nil {
+		return
+	}
+	if err = w.Close(); err != nil {
+		return
+	}
+	return client.Quit()
+}
+
+// Sends through the wrapped mailer with one worker, so a slow mail server
+// never piles up goroutines. The mails beyond the queue size are dropped.
+type AsyncMailer struct {
+	mailer  Mailer
+	queue   chan *Mail
+	done    chan bool
+	stopped bool
+	lock    sync.Mutex
+}
+
+func NewAsyncMailer(mailer Mailer, size int) *AsyncMailer {
+	async := &AsyncMailer{mailer: mailer, queue: make(chan *Mail, size), done: make(chan bool)}
+	go async.work()
+	return async
+}
+
+func (this *AsyncMailer) Send(mail *Mail) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.stopped {
+		return ErrStopped
+	}
+
+	select {
+	case this.queue <- mail:
+		return nil
+	default:
+		return ErrQueueFull
+	}
+}
+
+// Takes no more mails and sends the queued ones, giving up when the deadline passed
+func (this *AsyncMailer) Stop(deadline time.Time) error {
+	this.lock.Lock()
+	if !this.stopped {
+		this.stopped = true
+		close(this.queue)
+	}
+	this.lock.Unlock()
+
+	select {
+	case <-this.done:
+		return nil
+	case <-time.After(deadline.Sub(time.Now())):
+		return fmt.Errorf("Mailer: deadline exceeded, %d mails are not sent", len(this.queue))
+	}
+}
+
+func (this *AsyncMailer) work() {
+	defer close(this.done)
+
+	for mail := range this.queue {
+		if err := this.mailer.Send(mail); err != nil {
+			log.Printf("Mail to %s error: %s\n", mail.To, err)
+		}
+	}
+}
+
+// Writes every mail into a file of the dir, for the development
+type FileMailer struct {
+	dir  string
+	from string
+}
+
+func NewFileMailer(dir, from string) *FileMailer {
+	return &FileMailer{dir: dir, from: from}
+}
+
+func (this *FileMailer) Send(mail *Mail) (err error) {
+	msg, err := message(this.from, mail)
+	if err != nil {
+		return
+	}
+
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), strings.Replace(mail.To, "@", "_at_", -1))
+	return ioutil.WriteFile(filepath.Join(filepath.Clean(this.dir), filepath.Base(name)), msg, 0644)
+}
+
+// Keeps the mails in memory, for the tests
+type MemoryMailer struct {
+	mails []*Mail
+	lock  sync.Mutex
+}
+
+func NewMemoryMailer() *MemoryMailer {
+	return new(MemoryMailer)
+}
+
+func (this *MemoryMailer) Send(mail *Mail) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.mails = append(this.mails, mail)
+	return nil
+}
+
+// Snapshot of the sent mails
+func (this *MemoryMailer) Mails() []*Mail {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return append([]*Mail{}, this.mails...)
+}
+
+func (this *MemoryMailer) Reset() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.mails = nil
+}
+
+// The addresses must be plain addresses, the subject is encoded, so
+// nothing in them can add a header or start the body
+func message(from string, mail *Mail) (msg []byte, err error) {
+	if from, err = plainAddress(from); err != nil {
+		return
+	}
+	to, err := plainAddress(mail.To)
+	if err != nil {
+		return
+	}
+
+	msg = []byte("From: " + from + "\r\n" +
+		"To: " + to + "\r\n" +
+		"Subject: " + encodeHeader(mail.Subject) + "\r\n" +
+		"MIME-Version: 1.0\r\n" +
+		"Content-Type: text/plain; charset=UTF-8\r\n" +
+		"\r\n" + mail.Body)
+	return
+}
+
+func plainAddress(address string) (string, error) {
+	if strings.ContainsAny(address, "\r\n") {
+		return "", fmt.Errorf("Invalid mail address %q", address)
+	}
+	parsed, err := mail.ParseAddress(address)
+	if err != nil {
+		return "", fmt.Errorf("Invalid mail address %q: %s", address, err)
+	}
+	return parsed.Address, nil
+}
+
+// RFC 2047 encoded unless it is plain printable ASCII
+func encodeHeader(value string) string {
+	for _, r := range value {
+		if r < ' ' || r > '~' {
+			return "=?UTF-8?B?" + base64.StdEncoding.EncodeToString([]byte(value)) + "?="
+		}
+	}
+	return value
+}
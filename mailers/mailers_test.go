@@ -0,0 +1,203 @@
+package mailers
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMessageRejectsHeadersInAddresses(t *testing.T) {
+	cases := []struct {
+		from string
+		to   string
+	}{
+		{"noreply@example.com", "to@example.com\r\nBcc: someone@example.com"},
+		{"noreply@example.com\nBcc: someone@example.com", "to@example.com"},
+		{"noreply@example.com", "not an address"},
+	}
+
+	for _, c := range cases {
+		if _, err := message(c.from, &Mail{To: c.to, Subject: "Hi"}); err == nil {
+			t.Errorf("expected an error for from %q to %q", c.from, c.to)
+		}
+	}
+}
+
+func TestMessageEncodesSubject(t *testing.T) {
+	cases := []struct {
+		subject string
+		header  string
+	}{
+		{"Plain subject", "Subject: Plain subject\r\n"},
+		{"Hi\r\nBcc: someone@example.com", "Subject: =?UTF-8?B?SGkNCkJjYzogc29tZW9uZUBleGFtcGxlLmNvbQ==?=\r\n"},
+		{"こんにちは", "Subject: =?UTF-8?B?44GT44KT44Gr44Gh44Gv?=\r\n"},
+	}
+
+	for _, c := range cases {
+		msg, err := message("noreply@example.com", &Mail{To: "To <to@example.com>", Subject: c.subject, Body: "Body"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		header := strings.SplitN(string(msg), "\r\n\r\n", 2)[0] + "\r\n"
+		if !strings.Contains(header, c.header) {
+			t.Errorf("expected %q in %q", c.header, header)
+		}
+		if strings.Contains(header, "Bcc:") && !strings.Contains(header, "=?UTF-8?B?") {
+			t.Errorf("a header got injected: %q", header)
+		}
+		if !strings.Contains(header, "To: to@example.com\r\n") {
+			t.Errorf("expected the plain address in %q", header)
+		}
+	}
+}
+
+type blockingMailer struct {
+	release chan bool
+	sent    *MemoryMailer
+}
+
+func (this *blockingMailer) Send(mail *Mail) error {
+	<-this.release
+	return this.sent.Send(mail)
+}
+
+func TestAsyncMailerDropsWhenFull(t *testing.T) {
+	blocking := &blockingMailer{release: make(chan bool), sent: NewMemoryMailer()}
+	async := NewAsyncMailer(blocking, 1)
+
+	// The worker takes the first one and blocks, the second one waits in the queue
+	if err := async.Send(&Mail{To: "1@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for len(async.queue) != 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if err := async.Send(&Mail{To: "2@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := async.Send(&Mail{To: "3@example.com"}); err != ErrQueueFull {
+		t.Fatalf("expected ErrQueueFull, got %v", err)
+	}
+
+	close(blocking.release)
+	for len(blocking.sent.Mails()) != 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := len(blocking.sent.Mails()); n != 2 {
+		t.Fatalf("expected 2 mails sent, got %d", n)
+	}
+}
+
+func TestAsyncMailerStopSendsTheQueued(t *testing.T) {
+	blocking := &blockingMailer{release: make(chan bool), sent: NewMemoryMailer()}
+	async := NewAsyncMailer(blocking, 2)
+
+	async.Send(&Mail{To: "1@example.com"})
+	async.Send(&Mail{To: "2@example.com"})
+
+	if err := async.Stop(time.Now().Add(10 * time.Millisecond)); err == nil {
+		t.Fatal("expected the deadline to pass while the mail server hangs")
+	}
+	if err := async.Send(&Mail{To: "3@example.com"}); err != ErrStopped {
+		t.Fatalf("expected ErrStopped, got %v", err)
+	}
+
+	close(blocking.release)
+	if err := async.Stop(time.Now().Add(time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(blocking.sent.Mails()); n != 2 {
+		t.Fatalf("expected the 2 queued mails sent, got %d", n)
+	}
+}
+
+// Speaks enough SMTP for one mail, keeping the commands and the data it got
+type fakeSmtpServer struct {
+	listener net.Listener
+	commands chan string
+	data     chan string
+}
+
+func newFakeSmtpServer(t *testing.T) *fakeSmtpServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &fakeSmtpServer{listener: listener, commands: make(chan string, 20), data: make(chan string, 1)}
+	go server.serve()
+	return server
+}
+
+func (this *fakeSmtpServer) serve() {
+	conn, err := this.listener.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	text := textproto.NewConn(conn)
+	text.PrintfLine("220 fake ESMTP")
+	for {
+		line, err := text.ReadLine()
+		if err != nil {
+			return
+		}
+		this.commands <- line
+
+		switch strings.ToUpper(strings.SplitN(line, " ", 2)[0]) {
+		case "EHLO":
+			text.PrintfLine("250-fake")
+			text.PrintfLine("250 AUTH PLAIN")
+		case "AUTH":
+			text.PrintfLine("235 Authenticated")
+		case "DATA":
+			text.PrintfLine("354 Go ahead")
+			lines, _ := text.ReadDotLines()
+			this.data <- strings.Join(lines, "\n")
+			text.PrintfLine("250 Queued")
+		case "QUIT":
+			text.PrintfLine("221 Bye")
+			return
+		default:
+			text.PrintfLine("250 OK")
+		}
+	}
+}
+
+func TestSmtpMailerSend(t *testing.T) {
+	server := newFakeSmtpServer(t)
+	defer server.listener.Close()
+
+	smtpMailer := NewSmtpMailer(server.listener.Addr().String(), "user", "password", "Qortex <noreply@example.com>", time.Second)
+	if err := smtpMailer.Send(&Mail{To: "To <to@example.com>", Subject: "Hi", Body: "Body"}); err != nil {
+		t.Fatal(err)
+	}
+
+	close(server.commands)
+	var commands []string
+	for command := range server.commands {
+		commands = append(commands, command)
+	}
+	all := strings.Join(commands, "\n")
+
+	for _, expected := range []string{"AUTH PLAIN", "MAIL FROM:<noreply@example.com>", "RCPT TO:<to@example.com>", "QUIT"} {
+		if !strings.Contains(all, expected) {
+			t.Errorf("expected %q in the commands %q", expected, commands)
+		}
+	}
+
+	data := <-server.data
+	if !strings.Contains(data, "Subject: Hi") || !strings.Contains(data, "Body") {
+		t.Errorf("unexpected data %q", data)
+	}
+}
+
+func TestSmtpMailerHostOfIPv6(t *testing.T) {
+	if host := NewSmtpMailer("[::1]:25", "", "", "noreply@example.com", time.Second).host; host != "::1" {
+		t.Fatalf("expected ::1, got %q", host)
+	}
+}
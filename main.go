@@ -2,26 +2,178 @@ package main
 
 import (
 	"code.google.com/p/go.net/websocket"
+	"expvar"
+	"flag"
+	"github.com/kobeld/qortex-realtime/cluster"
 	"github.com/kobeld/qortex-realtime/configs"
 	"github.com/kobeld/qortex-realtime/consumers"
+	"github.com/kobeld/qortex-realtime/mailers"
+	"github.com/kobeld/qortex-realtime/producers"
 	"github.com/kobeld/qortex-realtime/services"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// The zero values leave the config as it is
+var (
+	configFile      = flag.String("config", "", "path of the config file, .json, .toml or .yaml")
+	wsPort          = flag.String("port", "", "websocket listening address, e.g. :5055")
+	nsqLookupd      = flag.String("nsqlookupd", "", "comma separated nsqlookupd addresses")
+	sendBufferSize  = flag.Int("send-buffer", 0, "pushes queued per connection")
+	maxRpc          = flag.Int("max-rpc", 0, "rpc calls running at a time per connection")
+	closeDuration   = flag.Duration("close-duration", 0, "grace period before an offline user is cleaned up")
+	writeTimeout    = flag.Duration("write-timeout", 0, "timeout of a websocket write")
+	rpcTimeout      = flag.Duration("rpc-timeout", 0, "timeout of an rpc call")
+	heartbeat       = flag.Duration("heartbeat", 0, "interval of the server pings")
+	idleTimeout     = flag.Duration("idle-timeout", 0, "a silent connection is killed after it")
+	shutdownTimeout = flag.Duration("shutdown-timeout", 0, "time given to drain the connections on shutdown")
 )
 
 func main() {
+	flag.Parse()
+
+	cfg, err := configs.Load(*configFile)
+	if err != nil {
+		log.Fatalln("Loading the config: " + err.Error())
+	}
+
+	// Command-line flags win over the file and the environment
+	if *wsPort != "" {
+		cfg.WSPort = *wsPort
+	}
+	if *nsqLookupd != "" {
+		cfg.NsqLookupdAddrs = configs.SplitList(*nsqLookupd)
+	}
+	applyFlags(cfg)
+
+	if cfg.NodeId == "" {
+		cfg.NodeId = configs.DefaultNodeId(cfg.WSPort)
+	}
+
+	if err = cfg.Validate(); err != nil {
+		log.Fatalln("Invalid config: " + err.Error())
+	}
+	if cfg.Env == configs.ENV_DEVELOPMENT {
+		log.Println("Running in development, the local origins are allowed. Set Env to production in the deployments.")
+	}
+
+	services.Init(cfg)
+
+	if cfg.ClusterMode() {
+		var bp cluster.Backplane = cluster.NewMemoryHub().Backplane()
+		if cfg.Backplane == configs.BACKPLANE_NSQ {
+			if bp, err = cluster.NewNsqBackplane(cfg.NsqdAddr, cfg.BackplaneTopic, cfg.NodeId, cfg.NsqLookupdAddrs); err != nil {
+				panic(err)
+			}
+		}
+		services.InitCluster(bp)
+		log.Printf("Running in cluster mode as node %s\n", cfg.NodeId)
+	}
+
+	if cfg.OfflineTopic != "" {
+		services.InitOfflineQueue(producers.NewNsqProducer(cfg.NsqdAddr))
+	}
+
+	if m := mailers.New(cfg); m != nil {
+		services.InitMailer(m)
+	}
+
 	// Register rpc methods
 	services.RegisterRpcs()
-	err := consumers.InitConsumers()
+	err = consumers.InitConsumers(cfg)
 	if err != nil {
 		panic(err)
 	}
 
-	http.Handle("/conn", websocket.Handler(services.BuildConnection))
+	// Only /conn is public, not what the imported packages put on http.DefaultServeMux
+	mux := http.NewServeMux()
+	mux.Handle("/conn", websocket.Server{
+		Handshake: services.Handshake,
+		Handler:   services.BuildConnection,
+	})
+
+	if cfg.MetricsAddr != "" {
+		go serveMetrics(cfg.MetricsAddr)
+	}
 
-	log.Printf("Starting websocket server on %s\n", configs.WSPort)
-	err = http.ListenAndServe(configs.WSPort, nil)
+	listener, err := net.Listen("tcp", cfg.WSPort)
 	if err != nil {
-		panic("ListenAndServe: " + err.Error())
+		panic("Listen: " + err.Error())
 	}
+
+	go waitForShutdown(cfg, listener)
+
+	log.Printf("Starting websocket server on %s\n", cfg.WSPort)
+	err = http.Serve(listener, mux)
+	if err != nil && !services.IsShuttingDown() {
+		panic("Serve: " + err.Error())
+	}
+
+	// Serve returns as soon as the listener is closed, hold on until draining is done
+	select {}
+}
+
+func applyFlags(cfg *configs.Config) {
+	if *sendBufferSize != 0 {
+		cfg.SendBufferSize = *sendBufferSize
+	}
+	if *maxRpc != 0 {
+		cfg.MaxRpcPerConnection = *maxRpc
+	}
+
+	durations := []struct {
+		flag    *time.Duration
+		setting *configs.Duration
+	}{
+		{closeDuration, &cfg.OnlineUserCloseDuration},
+		{writeTimeout, &cfg.WriteTimeout},
+		{rpcTimeout, &cfg.RpcTimeout},
+		{heartbeat, &cfg.HeartbeatInterval},
+		{idleTimeout, &cfg.IdleTimeout},
+		{shutdownTimeout, &cfg.ShutdownTimeout},
+	}
+	for _, d := range durations {
+		if *d.flag != 0 {
+			d.setting.Duration = *d.flag
+		}
+	}
+}
+
+// The expvar counters on their own listener
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/debug/vars", expvar.Handler())
+
+	log.Printf("Serving the metrics on %s\n", addr)
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Println("Metrics: " + err.Error())
+	}
+}
+
+// Drain the server on SIGTERM/SIGINT and exit within cfg.ShutdownTimeout
+func waitForShutdown(cfg *configs.Config, listener net.Listener) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
+	sig := <-sigChan
+
+	log.Printf("Got %s, shutting down in %s\n", sig, cfg.ShutdownTimeout)
+	deadline := time.Now().Add(cfg.ShutdownTimeout.Duration)
+
+	// Stop accepting /conn upgrades and ask the clients to reconnect elsewhere
+	services.StartShutdown()
+	listener.Close()
+
+	if err := consumers.StopConsumers(deadline); err != nil {
+		log.Println(err)
+	}
+
+	services.FinishShutdown(deadline)
+
+	log.Println("Shutdown finished")
+	os.Exit(0)
 }
@@ -3,6 +3,7 @@ package ws
 import (
 	"code.google.com/p/go.net/websocket"
 	"errors"
+	"github.com/kobeld/qortex-realtime/configs"
 	"github.com/sunfmin/mgodb"
 	"github.com/theplant/qortex/organizations"
 	"github.com/theplant/qortex/users"
@@ -11,60 +12,177 @@ import (
 	"sync"
 )
 
-// Should always contains a "Method" string for RPC protocal
+var (
+	ErrUserNotOnline = errors.New("No such user in running Org")
+	ErrOrgClosed     = errors.New("The Org is closed, it should be activated again")
+)
+
+// Anything sent to the client: the JSON-RPC responses, or the server pushes
+// which should implement MethodPush
 type GenericPushingMessage interface{}
 
+// Server pushes, sent as JSON-RPC 2.0 notifications of the method
+type MethodPush interface {
+	PushMethod() string
+}
+
 type ActiveOrg struct {
 	OrgId        string
 	Organization *organizations.Organization
 	OnlineUsers  map[bson.ObjectId]*OnlineUser
 	Broadcast    chan GenericPushingMessage
 	CloseSign    chan bool
+	Done         chan bool // Closed when the org stops running
 	AllDBs       []*mgodb.Database
+	Config       *configs.Config
+	NewMessages  NewMessageStore
 	Lock         sync.Mutex
+
+	// Set with Lock held once the org is out of the running ones, nobody can join it then
+	Closed bool
+
+	// Called out of the locks when a user comes online or is cleaned up
+	OnUserOnline  func(onlineUser *OnlineUser)
+	OnUserOffline func(onlineUser *OnlineUser)
 }
 
-func (this *ActiveOrg) GetOrInitOnlineUser(user *users.User, conn *websocket.Conn) (onlineUser *OnlineUser) {
+// resumeSeq is the last push seq the client got, or NO_RESUME.
+// ErrOrgClosed if the org has been closed since it was got.
+func (this *ActiveOrg) GetOrInitOnlineUser(user *users.User, wsConn *websocket.Conn, resumeSeq int64) (onlineUser *OnlineUser, conn *Connection, err error) {
 
-	this.Lock.Lock()
-	defer this.Lock.Unlock()
+	// The new messages of a new user are loaded before it is published, so
+	// a clear coming through it can't be undone by the loading
+	var messages []NewMessage
+	loaded := false
+	for {
+		this.Lock.Lock()
+		if this.Closed {
+			this.Lock.Unlock()
+			err = ErrOrgClosed
+			return
+		}
 
-	onlineUser = this.OnlineUsers[user.Id]
+		onlineUser = this.OnlineUsers[user.Id]
+		if onlineUser != nil || loaded {
+			break
+		}
+		this.Lock.Unlock()
+
+		messages = this.loadNewMessages(user)
+		loaded = true
+	}
+
+	isNew := false
 	if onlineUser == nil {
 		log.Printf("----> New online user %s", user.Email)
 		onlineUser = &OnlineUser{
 			InActivedOrg: this,
-			WsConns:      []*websocket.Conn{},
 			User:         user,
-			Send:         make(chan GenericPushingMessage, 32),
+			NewMessages:  messages,
 		}
 		this.OnlineUsers[user.Id] = onlineUser
-		go onlineUser.PushToClient()
+		isNew = true
 	}
 
-	if onlineUser.CloseTimer != nil {
-		onlineUser.CloseTimer.Stop()
+	conn = onlineUser.addConnection(wsConn, resumeSeq)
+	this.Lock.Unlock()
+
+	if isNew && this.OnUserOnline != nil {
+		this.OnUserOnline(onlineUser)
 	}
-	onlineUser.WsConns = append(onlineUser.WsConns, conn)
+	return
+}
 
+// The messages kept before the user came online (here or on another node)
+func (this *ActiveOrg) loadNewMessages(user *users.User) (messages []NewMessage) {
+	if this.NewMessages == nil {
+		return
+	}
+
+	messages, err := this.NewMessages.Load(this.OrgId, user.Id.Hex())
+	if err != nil {
+		log.Printf("Loading new messages of %+v error: %s \n", user.Email, err)
+	}
 	return
 }
 
+// Push to every online user through the running org.
+// It returns false if the org has stopped running.
+func (this *ActiveOrg) BroadcastPush(msg GenericPushingMessage) bool {
+	select {
+	case this.Broadcast <- msg:
+		return true
+	case <-this.Done:
+		return false
+	}
+}
+
 func (this *ActiveOrg) GetOnlineUserById(userId bson.ObjectId) (onlineUser *OnlineUser, err error) {
+	this.Lock.Lock()
+	defer this.Lock.Unlock()
+
 	ok := false
 	onlineUser, ok = this.OnlineUsers[userId]
 	if !ok {
-		err = errors.New("No such user in running Org")
+		err = ErrUserNotOnline
 		return
 	}
 
 	return
 }
 
-func (this *ActiveOrg) KillUser(userId bson.ObjectId) {
+// Snapshot of the current online users
+func (this *ActiveOrg) OnlineUserList() (onlineUsers []*OnlineUser) {
+	this.Lock.Lock()
+	defer this.Lock.Unlock()
+
+	for _, onlineUser := range this.OnlineUsers {
+		onlineUsers = append(onlineUsers, onlineUser)
+	}
+	return
+}
+
+// Push to the connections subscribing the topic
+func (this *ActiveOrg) PushToSubscribers(topic string, msg GenericPushingMessage) {
+	this.PushToOthers([]string{topic}, msg, "")
+}
+
+// Push once to the connections subscribing any of the topics, except the ones of the user.
+// The topic pushes are ephemeral, they are neither numbered nor replayed (see SequencedPush).
+func (this *ActiveOrg) PushToOthers(topics []string, msg GenericPushingMessage, exceptUserId bson.ObjectId) {
+	for _, onlineUser := range this.OnlineUserList() {
+		if onlineUser.User.Id == exceptUserId {
+			continue
+		}
+		for _, conn := range onlineUser.Connections() {
+			if conn.IsSubscribedAny(topics) && !conn.Push(msg) {
+				onlineUser.KillConnection(conn)
+			}
+		}
+	}
+}
+
+// Remove the user if there is no connection left, returns whether it is removed
+func (this *ActiveOrg) KillUser(userId bson.ObjectId) bool {
+	this.Lock.Lock()
+
+	onlineUser, ok := this.OnlineUsers[userId]
+	if !ok || onlineUser.ConnectionCount() > 0 {
+		this.Lock.Unlock()
+		return false
+	}
+
 	delete(this.OnlineUsers, userId)
-	// If no one in group, close and clean the resouce.
-	if len(this.OnlineUsers) == 0 {
-		this.CloseSign <- true
+	isEmpty := len(this.OnlineUsers) == 0
+	this.Lock.Unlock()
+
+	// If no one in group, close and clean the resouce. The org checks again whether
+	// it is empty, one pending sign is enough.
+	if isEmpty {
+		select {
+		case this.CloseSign <- true:
+		default:
+		}
 	}
+	return true
 }
@@ -0,0 +1,176 @@
+package ws
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"github.com/kobeld/qortex-realtime/jsonrpc2"
+	"labix.org/v2/mgo/bson"
+	"log"
+	"sync"
+	"time"
+)
+
+// One websocket of an online user (a browser tab, a mobile client...).
+// Each connection owns its push queue and writer goroutine, so a slow or
+// dead socket never holds back the other connections of the user.
+type Connection struct {
+	Id            string
+	Ws            *websocket.Conn
+	Owner         *OnlineUser
+	Queue         *PushQueue
+	closed        bool
+	subscriptions map[string]bool
+	viewing       string
+	state         string
+	lastActiveAt  time.Time
+	lock          sync.Mutex
+}
+
+func newConnection(owner *OnlineUser, wsConn *websocket.Conn) (conn *Connection) {
+	cfg := owner.InActivedOrg.Config
+	conn = &Connection{
+		Id:    bson.NewObjectId().Hex(),
+		Ws:    wsConn,
+		Owner: owner,
+		Queue: NewPushQueue(cfg.SendBufferSize, cfg.OverflowPolicy),
+
+		subscriptions: make(map[string]bool),
+		state:         STATE_ACTIVE,
+		lastActiveAt:  time.Now(),
+	}
+	// Without a websocket (in the tests) the pushes stay in the queue
+	if wsConn != nil {
+		go conn.writeLoop()
+	}
+	return
+}
+
+// Queue the push without blocking. It returns false if the connection
+// can't take it any more and should be killed.
+func (this *Connection) Push(msg GenericPushingMessage) bool {
+	return this.Queue.Push(msg)
+}
+
+// Queue the JSON-RPC response, it is never dropped for the pushes.
+// It returns false if the connection can't take it and should be killed.
+func (this *Connection) Respond(msg GenericPushingMessage) bool {
+	return this.Queue.PushResponse(msg)
+}
+
+// Close the queue and the websocket, it is safe to be called many times.
+// The websocket is closed in the background, its Close waits for the write
+// in progress, which may take until the write deadline for a slow client.
+func (this *Connection) Close() {
+	this.lock.Lock()
+	if this.closed {
+		this.lock.Unlock()
+		return
+	}
+	this.closed = true
+	this.lock.Unlock()
+
+	this.Queue.Close()
+	if this.Ws != nil {
+		go this.Ws.Close()
+	}
+}
+
+// Topics are the pushes the client asks for, e.g. "presence", "group:<id>"
+func (this *Connection) Subscribe(topic string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.subscriptions[topic] = true
+}
+
+func (this *Connection) Unsubscribe(topic string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	delete(this.subscriptions, topic)
+}
+
+func (this *Connection) SubscriptionCount() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return len(this.subscriptions)
+}
+
+// The entry or conversation the client is looking at, e.g. "entry:<id>".
+// It is subscribed like the other topics, but replaced by the next one.
+func (this *Connection) View(topic string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.viewing = topic
+}
+
+func (this *Connection) IsSubscribed(topic string) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.subscriptions[topic] || this.viewing == topic
+}
+
+func (this *Connection) IsSubscribedAny(topics []string) bool {
+	for _, topic := range topics {
+		if this.IsSubscribed(topic) {
+			return true
+		}
+	}
+	return false
+}
+
+// The client reports its activity, one of active/idle/away
+func (this *Connection) ReportState(state string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.state = state
+	if state == STATE_ACTIVE {
+		this.lastActiveAt = time.Now()
+	}
+}
+
+func (this *Connection) State() (state string, lastActiveAt time.Time) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.state, this.lastActiveAt
+}
+
+func (this *Connection) IsClosed() bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return this.closed
+}
+
+// Wait for the queued pushes to be written, at most until the deadline
+func (this *Connection) Flush(deadline time.Time) {
+	for this.Queue.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Write the queued pushes to the websocket until the queue is closed.
+// The connection is killed on the first failed write.
+func (this *Connection) writeLoop() {
+	timeout := this.Owner.InActivedOrg.Config.WriteTimeout.Duration
+
+	for {
+		msg, ok := this.Queue.Pop()
+		if !ok {
+			return
+		}
+
+		switch push := msg.(type) {
+		case *SequencedPush:
+			notification := jsonrpc2.NewNotification(push.PushMethod(), push.Push)
+			notification.Seq = push.Seq
+			msg = notification
+		case MethodPush:
+			msg = jsonrpc2.NewNotification(push.PushMethod(), push)
+		}
+
+		this.Ws.SetWriteDeadline(time.Now().Add(timeout))
+		if err := websocket.JSON.Send(this.Ws, msg); err != nil {
+			log.Printf("WS %s: Send %+v to %+v error: %s \n", this.Id, msg, this.Owner.User.Email, err)
+			this.Owner.KillConnection(this)
+			return
+		}
+	}
+}
@@ -0,0 +1,235 @@
+package ws
+
+import (
+	"github.com/sunfmin/mgodb"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"sync"
+	"time"
+)
+
+const (
+	NEW_MESSAGES_COLLECTION = "realtime_new_messages"
+)
+
+// A new message of a user. It is counted in its scope (the group or conversation),
+// and read with its root entry, e.g. the new comments are read with their post.
+type NewMessage struct {
+	Scope   string
+	RootId  string
+	EntryId string
+}
+
+// Where the new messages of a user in an organization are kept, so the
+// "N new messages" badges survive restarts and moving to another node.
+// Clear with an empty scope clears all of them. The messages expire after
+// the store's TTL, Load gives the living ones, the oldest first.
+type NewMessageStore interface {
+	Load(orgId, userId string) (messages []NewMessage, err error)
+	Add(orgId, userId string, message NewMessage) error
+	DeleteRoot(orgId, userId, rootId string) error
+	Clear(orgId, userId, scope string) error
+}
+
+type storedNewMessage struct {
+	OrgId     string
+	UserId    string
+	Scope     string
+	RootId    string
+	EntryId   string
+	CreatedAt time.Time
+}
+
+// The ones stored before the roots were kept are their own roots
+func (this storedNewMessage) message() NewMessage {
+	message := NewMessage{Scope: this.Scope, RootId: this.RootId, EntryId: this.EntryId}
+	if message.RootId == "" {
+		message.RootId = message.EntryId
+	}
+	return message
+}
+
+// Kept in the database of the organization, expired by a TTL index
+type MongoNewMessageStore struct {
+	db  *mgodb.Database
+	ttl time.Duration
+}
+
+// The indexes are made by EnsureIndexes, the store works without them
+func NewMongoNewMessageStore(db *mgodb.Database, ttl time.Duration) *MongoNewMessageStore {
+	return &MongoNewMessageStore{db: db, ttl: ttl}
+}
+
+// The TTL index of another TTL can't be ensured, it is dropped and made again
+func (this *MongoNewMessageStore) EnsureIndexes() (err error) {
+	this.db.CollectionDo(NEW_MESSAGES_COLLECTION, func(c *mgo.Collection) {
+		if err = c.EnsureIndex(mgo.Index{Key: []string{"orgid", "userid", "entryid"}, Unique: true}); err != nil {
+			return
+		}
+
+		ttlIndex := mgo.Index{Key: []string{"createdat"}, ExpireAfter: this.ttl}
+		if err = c.EnsureIndex(ttlIndex); err == nil {
+			return
+		}
+		if err = c.DropIndex("createdat"); err != nil {
+			return
+		}
+		err = c.EnsureIndex(ttlIndex)
+	})
+	return
+}
+
+func (this *MongoNewMessageStore) Load(orgId, userId string) (messages []NewMessage, err error) {
+	var stored []storedNewMessage
+	this.db.CollectionDo(NEW_MESSAGES_COLLECTION, func(c *mgo.Collection) {
+		// The TTL monitor runs once a minute, skip the expired ones it hasn't removed
+		err = c.Find(bson.M{
+			"orgid":     orgId,
+			"userid":    userId,
+			"createdat": bson.M{"$gt": time.Now().Add(-this.ttl)},
+		}).Sort("createdat").All(&stored)
+	})
+
+	for _, s := range stored {
+		messages = append(messages, s.message())
+	}
+	return
+}
+
+func (this *MongoNewMessageStore) Add(orgId, userId string, message NewMessage) (err error) {
+	this.db.CollectionDo(NEW_MESSAGES_COLLECTION, func(c *mgo.Collection) {
+		_, err = c.Upsert(
+			bson.M{"orgid": orgId, "userid": userId, "entryid": message.EntryId},
+			bson.M{"$set": bson.M{"scope": message.Scope, "rootid": message.RootId, "createdat": time.Now()}},
+		)
+	})
+	return
+}
+
+func (this *MongoNewMessageStore) DeleteRoot(orgId, userId, rootId string) (err error) {
+	this.db.CollectionDo(NEW_MESSAGES_COLLECTION, func(c *mgo.Collection) {
+		_, err = c.RemoveAll(bson.M{
+			"orgid":  orgId,
+			"userid": userId,
+			"$or":    []bson.M{{"rootid": rootId}, {"entryid": rootId}},
+		})
+	})
+	return
+}
+
+func (this *MongoNewMessageStore) Clear(orgId, userId, scope string) (err error) {
+	selector := bson.M{"orgid": orgId, "userid": userId}
+	if scope != "" {
+		selector["scope"] = scope
+	}
+
+	this.db.CollectionDo(NEW_MESSAGES_COLLECTION, func(c *mgo.Collection) {
+		_, err = c.RemoveAll(selector)
+	})
+	return
+}
+
+// Kept in the process, for a single node and the development.
+// It survives the user going offline, but not a restart. The users never
+// coming back are swept once their messages expire.
+type MemoryNewMessageStore struct {
+	ttl       time.Duration
+	messages  map[string][]storedNewMessage
+	lastSweep time.Time
+	lock      sync.Mutex
+}
+
+func NewMemoryNewMessageStore(ttl time.Duration) *MemoryNewMessageStore {
+	return &MemoryNewMessageStore{ttl: ttl, messages: make(map[string][]storedNewMessage), lastSweep: time.Now()}
+}
+
+// Drop the expired messages of all the users, at most once a minute (or ttl)
+func (this *MemoryNewMessageStore) sweep() {
+	interval := time.Minute
+	if this.ttl < interval {
+		interval = this.ttl
+	}
+	if time.Since(this.lastSweep) < interval {
+		return
+	}
+
+	this.lastSweep = time.Now()
+	for key := range this.messages {
+		this.set(key, this.living(key, func(s storedNewMessage) bool { return true }))
+	}
+}
+
+func (this *MemoryNewMessageStore) Load(orgId, userId string) (messages []NewMessage, err error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	key := orgId + "/" + userId
+	stored := this.living(key, func(s storedNewMessage) bool { return true })
+	this.set(key, stored)
+
+	for _, s := range stored {
+		messages = append(messages, s.message())
+	}
+	return
+}
+
+func (this *MemoryNewMessageStore) Add(orgId, userId string, message NewMessage) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.sweep()
+
+	key := orgId + "/" + userId
+	stored := this.living(key, func(s storedNewMessage) bool { return s.EntryId != message.EntryId })
+	stored = append(stored, storedNewMessage{
+		OrgId:     orgId,
+		UserId:    userId,
+		Scope:     message.Scope,
+		RootId:    message.RootId,
+		EntryId:   message.EntryId,
+		CreatedAt: time.Now(),
+	})
+	this.set(key, stored)
+	return nil
+}
+
+func (this *MemoryNewMessageStore) DeleteRoot(orgId, userId, rootId string) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	key := orgId + "/" + userId
+	this.set(key, this.living(key, func(s storedNewMessage) bool { return s.message().RootId != rootId && s.EntryId != rootId }))
+	return nil
+}
+
+func (this *MemoryNewMessageStore) Clear(orgId, userId, scope string) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	key := orgId + "/" + userId
+	if scope == "" {
+		delete(this.messages, key)
+		return nil
+	}
+
+	this.set(key, this.living(key, func(s storedNewMessage) bool { return s.Scope != scope }))
+	return nil
+}
+
+// The messages not expired yet and kept by the filter
+func (this *MemoryNewMessageStore) living(key string, keep func(s storedNewMessage) bool) (stored []storedNewMessage) {
+	for _, s := range this.messages[key] {
+		if keep(s) && time.Since(s.CreatedAt) < this.ttl {
+			stored = append(stored, s)
+		}
+	}
+	return
+}
+
+func (this *MemoryNewMessageStore) set(key string, stored []storedNewMessage) {
+	if len(stored) == 0 {
+		delete(this.messages, key)
+		return
+	}
+	this.messages[key] = stored
+}
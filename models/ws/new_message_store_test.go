@@ -0,0 +1,167 @@
+package ws
+
+import (
+	"github.com/kobeld/qortex-realtime/configs"
+	"github.com/theplant/qortex/users"
+	"labix.org/v2/mgo/bson"
+	"reflect"
+	"testing"
+	"time"
+)
+
+const (
+	testOrgId  = "org"
+	testUserId = "user"
+)
+
+func loadScopes(t *testing.T, store NewMessageStore) map[string][]string {
+	messages, err := store.Load(testOrgId, testUserId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scopes := make(map[string][]string)
+	for _, message := range messages {
+		scopes[message.Scope] = append(scopes[message.Scope], message.EntryId)
+	}
+	return scopes
+}
+
+func addNewMessages(store NewMessageStore, messages ...NewMessage) {
+	for _, message := range messages {
+		store.Add(testOrgId, testUserId, message)
+	}
+}
+
+func TestMemoryNewMessageStoreGroupsByScope(t *testing.T) {
+	store := NewMemoryNewMessageStore(time.Hour)
+	addNewMessages(store,
+		NewMessage{Scope: "group:a", RootId: "post1", EntryId: "post1"},
+		NewMessage{Scope: "conversation:b", RootId: "chat1", EntryId: "chat1"},
+		NewMessage{Scope: "group:a", RootId: "post1", EntryId: "comment1"},
+		NewMessage{Scope: "group:a", RootId: "post1", EntryId: "comment1"},
+	)
+
+	expected := map[string][]string{
+		"group:a":        {"post1", "comment1"},
+		"conversation:b": {"chat1"},
+	}
+	if scopes := loadScopes(t, store); !reflect.DeepEqual(scopes, expected) {
+		t.Fatalf("expected %v, got %v", expected, scopes)
+	}
+
+	// Another user has its own
+	if messages, _ := store.Load(testOrgId, "other"); len(messages) != 0 {
+		t.Fatalf("expected nothing for another user, got %v", messages)
+	}
+}
+
+func TestMemoryNewMessageStoreClear(t *testing.T) {
+	messages := []NewMessage{
+		{Scope: "group:a", RootId: "post1", EntryId: "post1"},
+		{Scope: "group:b", RootId: "post2", EntryId: "post2"},
+		{Scope: "conversation:c", RootId: "chat1", EntryId: "chat1"},
+	}
+
+	store := NewMemoryNewMessageStore(time.Hour)
+	addNewMessages(store, messages...)
+	store.Clear(testOrgId, testUserId, "group:a")
+
+	expected := map[string][]string{
+		"group:b":        {"post2"},
+		"conversation:c": {"chat1"},
+	}
+	if scopes := loadScopes(t, store); !reflect.DeepEqual(scopes, expected) {
+		t.Fatalf("expected %v after clearing the scope, got %v", expected, scopes)
+	}
+
+	store.Clear(testOrgId, testUserId, "")
+	if scopes := loadScopes(t, store); len(scopes) != 0 {
+		t.Fatalf("expected nothing after clearing all, got %v", scopes)
+	}
+}
+
+func TestMemoryNewMessageStoreDeleteRoot(t *testing.T) {
+	store := NewMemoryNewMessageStore(time.Hour)
+	addNewMessages(store,
+		NewMessage{Scope: "group:a", RootId: "post1", EntryId: "comment1"},
+		NewMessage{Scope: "group:a", RootId: "post1", EntryId: "comment2"},
+		NewMessage{Scope: "group:a", RootId: "post2", EntryId: "post2"},
+	)
+	store.DeleteRoot(testOrgId, testUserId, "post1")
+
+	expected := map[string][]string{"group:a": {"post2"}}
+	if scopes := loadScopes(t, store); !reflect.DeepEqual(scopes, expected) {
+		t.Fatalf("expected %v, got %v", expected, scopes)
+	}
+}
+
+func TestMemoryNewMessageStoreExpires(t *testing.T) {
+	store := NewMemoryNewMessageStore(10 * time.Millisecond)
+	addNewMessages(store, NewMessage{Scope: "group:a", RootId: "post1", EntryId: "post1"})
+
+	time.Sleep(20 * time.Millisecond)
+	if scopes := loadScopes(t, store); len(scopes) != 0 {
+		t.Fatalf("expected the expired ones gone, got %v", scopes)
+	}
+}
+
+func TestStoredNewMessageWithoutRoot(t *testing.T) {
+	message := storedNewMessage{Scope: "group:a", EntryId: "post1"}.message()
+	if message.RootId != "post1" {
+		t.Fatalf("expected the entry to be its own root, got %q", message.RootId)
+	}
+}
+
+func TestMemoryNewMessageStoreSweepsGoneUsers(t *testing.T) {
+	store := NewMemoryNewMessageStore(10 * time.Millisecond)
+	store.Add(testOrgId, "gone", NewMessage{Scope: "group:a", EntryId: "post1"})
+
+	time.Sleep(20 * time.Millisecond)
+	addNewMessages(store, NewMessage{Scope: "group:a", EntryId: "post2"})
+
+	store.lock.Lock()
+	_, kept := store.messages[testOrgId+"/gone"]
+	store.lock.Unlock()
+	if kept {
+		t.Fatal("expected the user never coming back swept")
+	}
+}
+
+// Tells whether the user was already published when its messages were loaded
+type publishCheckingStore struct {
+	*MemoryNewMessageStore
+	org       *ActiveOrg
+	published bool
+}
+
+func (this *publishCheckingStore) Load(orgId, userId string) ([]NewMessage, error) {
+	this.org.Lock.Lock()
+	for id := range this.org.OnlineUsers {
+		this.published = this.published || id.Hex() == userId
+	}
+	this.org.Lock.Unlock()
+	return this.MemoryNewMessageStore.Load(orgId, userId)
+}
+
+func TestNewMessagesLoadedBeforeTheUserIsPublished(t *testing.T) {
+	activeOrg := &ActiveOrg{
+		OrgId:       bson.NewObjectId().Hex(),
+		OnlineUsers: make(map[bson.ObjectId]*OnlineUser),
+		CloseSign:   make(chan bool, 1),
+		Config:      configs.Default(),
+	}
+	store := &publishCheckingStore{MemoryNewMessageStore: NewMemoryNewMessageStore(time.Hour), org: activeOrg}
+	activeOrg.NewMessages = store
+
+	user := &users.User{Id: bson.NewObjectId()}
+	store.Add(activeOrg.OrgId, user.Id.Hex(), NewMessage{Scope: "group:a", EntryId: "post1"})
+
+	onlineUser, _, _ := activeOrg.GetOrInitOnlineUser(user, nil, NO_RESUME)
+	if store.published {
+		t.Fatal("expected the messages loaded before the user is published")
+	}
+	if number := onlineUser.NewMessageNumber(); number != 1 {
+		t.Fatalf("expected the stored message loaded, got %d", number)
+	}
+}
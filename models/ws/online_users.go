@@ -2,110 +2,290 @@ package ws
 
 import (
 	"code.google.com/p/go.net/websocket"
-	"github.com/kobeld/qortex-realtime/configs"
 	"github.com/sunfmin/mgodb"
 	"github.com/theplant/qortex/users"
-	"github.com/theplant/qortex/utils"
 	"log"
 	"sync"
 	"time"
 )
 
+// All the fields below Lock are guarded by it
 type OnlineUser struct {
-	InActivedOrg  *ActiveOrg
-	WsConns       []*websocket.Conn
-	User          *users.User
-	NewMessageIds []string
-	Send          chan GenericPushingMessage
-	Lock          sync.Mutex
-	CloseTimer    *time.Timer
+	InActivedOrg *ActiveOrg
+	User         *users.User
+	Lock         sync.Mutex
+	Conns        []*Connection
+	NewMessages  []NewMessage // The new messages, the oldest first
+	CloseTimer   *time.Timer
+	Closing      bool
+	DoNotDisturb bool
+
+	// The latest activity of the connections already gone
+	lastActiveAt time.Time
+
+	// The last push seq, and the latest pushes for the resuming connections
+	lastSeq uint64
+	replay  []*SequencedPush
 }
 
 func (this *OnlineUser) AllDBs() []*mgodb.Database {
 	return this.InActivedOrg.AllDBs
 }
 
-// Push realtime message from server to client
-func (this *OnlineUser) PushToClient() {
-	for ntf := range this.Send {
-		for _, ws := range this.WsConns {
-			err := websocket.JSON.Send(ws, ntf)
-			if err != nil {
-				log.Printf("WS %+v: Send %+v to %+v error! \n", ws, ntf, this.User.Email)
-			}
-		}
+func (this *OnlineUser) addConnection(wsConn *websocket.Conn, resumeSeq int64) (conn *Connection) {
+	this.Lock.Lock()
+	defer this.Lock.Unlock()
+
+	if this.CloseTimer != nil {
+		this.CloseTimer.Stop()
 	}
+	conn = newConnection(this, wsConn)
+	this.resume(conn, resumeSeq)
+	this.Conns = append(this.Conns, conn)
+	return
 }
 
+// Snapshot of the living connections
+func (this *OnlineUser) Connections() []*Connection {
+	this.Lock.Lock()
+	defer this.Lock.Unlock()
+	return append([]*Connection{}, this.Conns...)
+}
+
+func (this *OnlineUser) ConnectionCount() int {
+	this.Lock.Lock()
+	defer this.Lock.Unlock()
+	return len(this.Conns)
+}
+
+// Whether the user is still in the org with a living connection
+func (this *OnlineUser) IsOnline() bool {
+	org := this.InActivedOrg
+	org.Lock.Lock()
+	defer org.Lock.Unlock()
+	return org.OnlineUsers[this.User.Id] == this && this.ConnectionCount() > 0
+}
+
+// Fan out the reply to every connection of the user without blocking.
+// The pushes are numbered and kept for the reconnecting clients.
+// A connection whose queue overflows under the disconnect policy is killed,
+// the client will reconnect and resume.
 func (this *OnlineUser) SendReply(reply GenericPushingMessage) {
-	defer func() {
-		if err := recover(); err != nil {
-			utils.PrintStackAndError(err.(error))
+	this.Lock.Lock()
+	if push, ok := reply.(MethodPush); ok {
+		reply = this.sequence(push)
+	}
+
+	var failed []*Connection
+	for _, conn := range this.Conns {
+		if !conn.Push(reply) {
+			failed = append(failed, conn)
 		}
-	}()
-	this.Send <- reply
+	}
+	this.Lock.Unlock()
+
+	for _, conn := range failed {
+		log.Printf("WS %s: Push queue of %+v is full, disconnecting. \n", conn.Id, this.User.Email)
+		this.KillConnection(conn)
+	}
 }
 
-func (this *OnlineUser) ClearNewMessageId() int {
+// Wait for the pending pushes to be sent out (or the deadline passed),
+// then close all the connections of the user
+func (this *OnlineUser) Drain(deadline time.Time) {
 	this.Lock.Lock()
-	defer this.Lock.Unlock()
-	this.NewMessageIds = []string{}
+	this.Closing = true
+	if this.CloseTimer != nil {
+		this.CloseTimer.Stop()
+	}
+	this.Lock.Unlock()
 
-	return 0
+	for _, conn := range this.Connections() {
+		conn.Flush(deadline)
+		conn.Close()
+	}
 }
 
-func (this *OnlineUser) DeleteNewMessageId(entryId string) int {
+func (this *OnlineUser) SetDoNotDisturb(enabled bool) {
 	this.Lock.Lock()
 	defer this.Lock.Unlock()
+	this.DoNotDisturb = enabled
+}
 
-	for i, id := range this.NewMessageIds {
-		if id == entryId {
-			this.NewMessageIds = append(this.NewMessageIds[:i], this.NewMessageIds[i+1:]...)
-		}
+// Aggregated over the connections, away if there is none left (in the grace period).
+// The last activity includes the connections already gone.
+func (this *OnlineUser) PresenceState() (state string, lastActiveAt time.Time) {
+	this.Lock.Lock()
+	dnd := this.DoNotDisturb
+	lastActiveAt = this.lastActiveAt
+	conns := append([]*Connection{}, this.Conns...)
+	this.Lock.Unlock()
+
+	state = STATE_AWAY
+	for _, conn := range conns {
+		connState, connLastActiveAt := conn.State()
+		state = MergeState(state, connState)
+		lastActiveAt = LaterTime(lastActiveAt, connLastActiveAt)
 	}
-	return len(this.NewMessageIds)
+
+	if dnd {
+		state = STATE_DND
+	}
+	return
 }
 
-func (this *OnlineUser) AddNewMessageId(entryId string) int {
+// The number of all the new messages
+func (this *OnlineUser) NewMessageNumber() int {
 	this.Lock.Lock()
 	defer this.Lock.Unlock()
+	return len(this.NewMessages)
+}
 
-	// No duplicated id
-	for _, id := range this.NewMessageIds {
-		if id == entryId {
-			return len(this.NewMessageIds)
+// The number of the new messages per scope, e.g. {"group:<id>": 3}
+func (this *OnlineUser) NewMessageCounts() (counts map[string]int) {
+	this.Lock.Lock()
+	defer this.Lock.Unlock()
+
+	counts = make(map[string]int)
+	for _, message := range this.NewMessages {
+		counts[message.Scope]++
+	}
+	return
+}
+
+// Clear the new messages of the scope, all of them if the scope is empty.
+// It returns the number left.
+func (this *OnlineUser) ClearNewMessageId(scope string) int {
+	this.Lock.Lock()
+	number := this.keepNewMessages(func(message NewMessage) bool {
+		return scope != "" && message.Scope != scope
+	})
+	this.Lock.Unlock()
+
+	this.storeNewMessages(func(store NewMessageStore, orgId, userId string) error {
+		return store.Clear(orgId, userId, scope)
+	})
+	return number
+}
+
+// Reading an entry reads the new messages under it too, e.g. the new comments of a post.
+// It returns the number left.
+func (this *OnlineUser) DeleteNewMessageRoot(rootId string) int {
+	this.Lock.Lock()
+	number := this.keepNewMessages(func(message NewMessage) bool {
+		return message.RootId != rootId && message.EntryId != rootId
+	})
+	this.Lock.Unlock()
+
+	this.storeNewMessages(func(store NewMessageStore, orgId, userId string) error {
+		return store.DeleteRoot(orgId, userId, rootId)
+	})
+	return number
+}
+
+// A message without a root is its own root
+func (this *OnlineUser) AddNewMessageId(message NewMessage) int {
+	if message.RootId == "" {
+		message.RootId = message.EntryId
+	}
+
+	this.Lock.Lock()
+	added := this.addNewMessage(message)
+	number := len(this.NewMessages)
+	this.Lock.Unlock()
+
+	if added {
+		this.storeNewMessages(func(store NewMessageStore, orgId, userId string) error {
+			return store.Add(orgId, userId, message)
+		})
+	}
+	return number
+}
+
+// No duplicated id, with this.Lock held
+func (this *OnlineUser) addNewMessage(message NewMessage) (added bool) {
+	for _, m := range this.NewMessages {
+		if m.EntryId == message.EntryId {
+			return false
 		}
 	}
 
-	this.NewMessageIds = append(this.NewMessageIds, entryId)
-	return len(this.NewMessageIds)
+	this.NewMessages = append(this.NewMessages, message)
+	return true
 }
 
-func (this *OnlineUser) KillWebsocket(conn *websocket.Conn) {
+// Keep the new messages the filter keeps, returns the number left. With this.Lock held.
+func (this *OnlineUser) keepNewMessages(keep func(message NewMessage) bool) int {
+	var kept []NewMessage
+	for _, message := range this.NewMessages {
+		if keep(message) {
+			kept = append(kept, message)
+		}
+	}
+	this.NewMessages = kept
+	return len(kept)
+}
+
+// Write through to the store, out of this.Lock. The memory copy still
+// works when the store fails.
+func (this *OnlineUser) storeNewMessages(do func(store NewMessageStore, orgId, userId string) error) {
+	store := this.InActivedOrg.NewMessages
+	if store == nil {
+		return
+	}
+
+	if err := do(store, this.InActivedOrg.OrgId, this.User.Id.Hex()); err != nil {
+		log.Printf("Storing new messages of %+v error: %s \n", this.User.Email, err)
+	}
+}
+
+func (this *OnlineUser) UpdateOfflineTime() {
+	this.User.UpdateOfflineTime(this.InActivedOrg.Organization.Database)
+}
+
+// Remove the connection and close it. When the last one is gone, the user
+// is cleaned up after the grace period unless a new connection comes in.
+func (this *OnlineUser) KillConnection(conn *Connection) {
+	conn.Close()
+	_, connLastActiveAt := conn.State()
+
 	this.Lock.Lock()
 	defer this.Lock.Unlock()
 
-	for index, wsConn := range this.WsConns {
-		if wsConn == conn {
-			this.WsConns = append(this.WsConns[:index], this.WsConns[index+1:]...)
-			log.Printf("Killing WebSocket for %+v, left %+v connection.  \n", this.User.Email, len(this.WsConns))
+	found := false
+	for index, c := range this.Conns {
+		if c == conn {
+			this.Conns = append(this.Conns[:index], this.Conns[index+1:]...)
+			// So the user still has it once all the connections are gone
+			this.lastActiveAt = LaterTime(this.lastActiveAt, connLastActiveAt)
+			found = true
+			log.Printf("Killing WebSocket for %+v, left %+v connection.  \n", this.User.Email, len(this.Conns))
+			break
 		}
 	}
-	conn.Close()
 
-	if len(this.WsConns) == 0 {
+	// Already killed, or the server is shutting down and the offline time is already handled
+	if !found || this.Closing {
+		return
+	}
+
+	if len(this.Conns) == 0 {
 		if this.CloseTimer != nil {
 			this.CloseTimer.Stop()
 		}
-		this.CloseTimer = time.AfterFunc(configs.ONLINE_USER_CLOSE_DURATION, func() {
-			log.Printf("Websocket: No other living BrowserSockets. Cleaning ( %+v ) resources. \n", this.User.Email)
-			this.InActivedOrg.KillUser(this.User.Id)
+		this.CloseTimer = time.AfterFunc(this.InActivedOrg.Config.OnlineUserCloseDuration.Duration, func() {
+			// A new connection came in right before the timer fired
+			if !this.InActivedOrg.KillUser(this.User.Id) {
+				return
+			}
+			log.Printf("Websocket: No other living BrowserSockets. Cleaned ( %+v ) resources. \n", this.User.Email)
 
-			// Update user offline time and put user into the offline queue for getting offline digest mail
-			this.User.UpdateOfflineTime(this.InActivedOrg.Organization.Database)
+			// Update user offline time, then the hook puts user into the offline queue for getting offline digest mail
+			this.UpdateOfflineTime()
 
-			// TODO: Enable it later
-			// PutOfflineUserIntoQueue(this.User, this.InOrganization.OrganizationId)
+			if this.InActivedOrg.OnUserOffline != nil {
+				this.InActivedOrg.OnUserOffline(this)
+			}
 		})
 	}
 }
@@ -0,0 +1,41 @@
+package ws
+
+import (
+	"time"
+)
+
+// Presence states of a user, the client reports the first three per
+// connection, do-not-disturb is set manually
+const (
+	STATE_ACTIVE = "active"
+	STATE_IDLE   = "idle"
+	STATE_AWAY   = "away"
+	STATE_DND    = "dnd"
+)
+
+var stateRanks = map[string]int{
+	STATE_AWAY:   1,
+	STATE_IDLE:   2,
+	STATE_ACTIVE: 3,
+	STATE_DND:    4,
+}
+
+func IsReportableState(state string) bool {
+	return state == STATE_ACTIVE || state == STATE_IDLE || state == STATE_AWAY
+}
+
+// The state of a user with several connections (or nodes):
+// do-not-disturb wins, then the most active one
+func MergeState(a, b string) string {
+	if stateRanks[b] > stateRanks[a] {
+		return b
+	}
+	return a
+}
+
+func LaterTime(a, b time.Time) time.Time {
+	if b.After(a) {
+		return b
+	}
+	return a
+}
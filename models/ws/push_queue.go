@@ -0,0 +1,165 @@
+package ws
+
+import (
+	"expvar"
+	"github.com/kobeld/qortex-realtime/configs"
+	"sync"
+)
+
+// Counters exposed on /debug/vars of config.MetricsAddr
+var (
+	DroppedPushes      = expvar.NewInt("ws_dropped_pushes")
+	CoalescedPushes    = expvar.NewInt("ws_coalesced_pushes")
+	SlowConsumerKicked = expvar.NewInt("ws_slow_consumer_disconnects")
+)
+
+// Pushes implementing it can replace a queued push with the same key,
+// e.g. an older Counter.Refresh is useless once a newer one is queued.
+type Coalescable interface {
+	CoalesceKey() string
+}
+
+// The JSON-RPC responses in the queue, the pushes are dropped before them
+type rpcResponse struct {
+	msg GenericPushingMessage
+}
+
+// A bounded outbound queue that never blocks the pusher,
+// the policy is one of the configs.OVERFLOW_* values
+type PushQueue struct {
+	size   int
+	policy string
+	items  []GenericPushingMessage
+	ready  chan bool
+	closed bool
+	lock   sync.Mutex
+}
+
+func NewPushQueue(size int, policy string) *PushQueue {
+	return &PushQueue{
+		size:   size,
+		policy: policy,
+		ready:  make(chan bool, 1),
+	}
+}
+
+// Put the push into the queue. It returns false if the queue is closed,
+// or it is full under the disconnect policy, then the consumer should be kicked.
+func (this *PushQueue) Push(msg GenericPushingMessage) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if this.closed {
+		return false
+	}
+
+	if len(this.items) >= this.size {
+		switch this.policy {
+		case configs.OVERFLOW_DISCONNECT:
+			DroppedPushes.Add(1)
+			SlowConsumerKicked.Add(1)
+			return false
+
+		case configs.OVERFLOW_COALESCE_REFRESH:
+			if this.coalesce(msg) {
+				CoalescedPushes.Add(1)
+				return true
+			}
+			fallthrough
+
+		default:
+			// Full of responses, the client isn't reading them
+			if !this.dropOldestPush() {
+				SlowConsumerKicked.Add(1)
+				return false
+			}
+			DroppedPushes.Add(1)
+		}
+	}
+
+	this.items = append(this.items, msg)
+	this.notify()
+	return true
+}
+
+// Like Push, but the response is never dropped for a later push. When the
+// queue can't take it, it returns false and the consumer should be kicked.
+func (this *PushQueue) PushResponse(msg GenericPushingMessage) bool {
+	return this.Push(rpcResponse{msg})
+}
+
+// Take the oldest push, blocking until there is one.
+// It returns false when the queue is closed.
+func (this *PushQueue) Pop() (msg GenericPushingMessage, ok bool) {
+	for {
+		this.lock.Lock()
+		if len(this.items) > 0 {
+			msg = this.items[0]
+			this.items = this.items[1:]
+			this.lock.Unlock()
+
+			if resp, ok := msg.(rpcResponse); ok {
+				msg = resp.msg
+			}
+			return msg, true
+		}
+		if this.closed {
+			this.lock.Unlock()
+			return nil, false
+		}
+		this.lock.Unlock()
+
+		<-this.ready
+	}
+}
+
+func (this *PushQueue) Len() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return len(this.items)
+}
+
+// Close the queue, the pushes already in it can still be popped
+func (this *PushQueue) Close() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	if !this.closed {
+		this.closed = true
+		this.notify()
+	}
+}
+
+// Replace the queued push having the same coalesce key
+func (this *PushQueue) coalesce(msg GenericPushingMessage) bool {
+	c, ok := msg.(Coalescable)
+	if !ok || c.CoalesceKey() == "" {
+		return false
+	}
+
+	for i, item := range this.items {
+		if queued, ok := item.(Coalescable); ok && queued.CoalesceKey() == c.CoalesceKey() {
+			this.items = append(this.items[:i], this.items[i+1:]...)
+			this.items = append(this.items, msg)
+			return true
+		}
+	}
+	return false
+}
+
+func (this *PushQueue) dropOldestPush() bool {
+	for i, item := range this.items {
+		if _, ok := item.(rpcResponse); !ok {
+			this.items = append(this.items[:i], this.items[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+func (this *PushQueue) notify() {
+	select {
+	case this.ready <- true:
+	default:
+	}
+}
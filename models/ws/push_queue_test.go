@@ -0,0 +1,55 @@
+package ws
+
+import (
+	"github.com/kobeld/qortex-realtime/configs"
+	"testing"
+)
+
+func popAll(queue *PushQueue) (msgs []GenericPushingMessage) {
+	for queue.Len() > 0 {
+		msg, _ := queue.Pop()
+		msgs = append(msgs, msg)
+	}
+	return
+}
+
+func TestPushQueueNeverDropsResponses(t *testing.T) {
+	for _, policy := range []string{configs.OVERFLOW_DROP_OLDEST, configs.OVERFLOW_COALESCE_REFRESH} {
+		queue := NewPushQueue(2, policy)
+		queue.PushResponse("response")
+		queue.Push("push 1")
+		queue.Push("push 2")
+
+		msgs := popAll(queue)
+		if len(msgs) != 2 || msgs[0] != "response" || msgs[1] != "push 2" {
+			t.Errorf("%s: expected the response and the latest push, got %v", policy, msgs)
+		}
+	}
+}
+
+func TestPushQueueFullOfResponses(t *testing.T) {
+	queue := NewPushQueue(2, configs.OVERFLOW_DROP_OLDEST)
+	queue.PushResponse("response 1")
+	queue.PushResponse("response 2")
+
+	if queue.Push("push") {
+		t.Fatal("expected the push to kick the consumer")
+	}
+	if queue.PushResponse("response 3") {
+		t.Fatal("expected the response to kick the consumer")
+	}
+
+	msgs := popAll(queue)
+	if len(msgs) != 2 || msgs[0] != "response 1" || msgs[1] != "response 2" {
+		t.Fatalf("expected the responses kept, got %v", msgs)
+	}
+}
+
+func TestPushQueueResponseUnderDisconnect(t *testing.T) {
+	queue := NewPushQueue(1, configs.OVERFLOW_DISCONNECT)
+	queue.Push("push")
+
+	if queue.PushResponse("response") {
+		t.Fatal("expected the response to kick the consumer")
+	}
+}
@@ -0,0 +1,107 @@
+package ws
+
+import (
+	"time"
+)
+
+const (
+	SERVER_SYNCED          = "Server.Synced"
+	SERVER_RESYNC_REQUIRED = "Server.ResyncRequired"
+
+	// The connection is not resuming a previous one
+	NO_RESUME int64 = -1
+)
+
+// A push sent by OnlineUser.SendReply, numbered per user. Seqs only grow,
+// a gap within a connection means pushes were dropped or coalesced.
+//
+// The pushes of the topics (ActiveOrg.PushToOthers: Entry.*, Typing, Presence.*)
+// and the pulses are ephemeral and carry no seq. They go to the subscribing
+// connections only, which subscribe again after reconnecting, and the client
+// refetches what the topic shows then.
+type SequencedPush struct {
+	Seq  uint64
+	Push MethodPush
+}
+
+func (this *SequencedPush) PushMethod() string {
+	return this.Push.PushMethod()
+}
+
+func (this *SequencedPush) CoalesceKey() string {
+	if c, ok := this.Push.(Coalescable); ok {
+		return c.CoalesceKey()
+	}
+	return ""
+}
+
+// The first push of a connection. Synced tells the seq the client is up to
+// date with, ResyncRequired tells the missed pushes are gone and the client
+// should refetch everything. Either way the client resumes from Seq next time.
+type SyncNotification struct {
+	Method string
+	Seq    uint64
+}
+
+func (this SyncNotification) PushMethod() string {
+	return this.Method
+}
+
+// Seqs start from the creation time in microseconds, so they keep growing
+// when the user is recreated (after the grace period, or on another node),
+// and resuming a stale seq always asks for a resync.
+func initialSeq() uint64 {
+	return uint64(time.Now().UnixNano() / int64(time.Microsecond))
+}
+
+// Number the push and keep it for replaying, with this.Lock held
+func (this *OnlineUser) sequence(push MethodPush) *SequencedPush {
+	if this.lastSeq == 0 {
+		this.lastSeq = initialSeq()
+	}
+	this.lastSeq++
+
+	sp := &SequencedPush{Seq: this.lastSeq, Push: push}
+
+	size := this.InActivedOrg.Config.ReplayBufferSize
+	if size <= 0 {
+		return sp
+	}
+	this.replay = append(this.replay, sp)
+	if len(this.replay) > size {
+		this.replay = this.replay[len(this.replay)-size:]
+	}
+	return sp
+}
+
+// Queue the pushes after resumeSeq on the new connection followed by Synced,
+// or tell it to resync if some are already gone. With this.Lock held, so no
+// push sent meanwhile is missed or doubled.
+func (this *OnlineUser) resume(conn *Connection, resumeSeq int64) {
+	if this.lastSeq == 0 {
+		this.lastSeq = initialSeq()
+	}
+
+	if resumeSeq == NO_RESUME {
+		conn.Push(SyncNotification{Method: SERVER_SYNCED, Seq: this.lastSeq})
+		return
+	}
+
+	seq := uint64(resumeSeq)
+	oldest := this.lastSeq + 1
+	if len(this.replay) > 0 {
+		oldest = this.replay[0].Seq
+	}
+
+	if seq > this.lastSeq || seq+1 < oldest {
+		conn.Push(SyncNotification{Method: SERVER_RESYNC_REQUIRED, Seq: this.lastSeq})
+		return
+	}
+
+	for _, sp := range this.replay {
+		if sp.Seq > seq {
+			conn.Push(sp)
+		}
+	}
+	conn.Push(SyncNotification{Method: SERVER_SYNCED, Seq: this.lastSeq})
+}
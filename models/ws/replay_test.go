@@ -0,0 +1,164 @@
+package ws
+
+import (
+	"github.com/kobeld/qortex-realtime/configs"
+	"github.com/theplant/qortex/users"
+	"labix.org/v2/mgo/bson"
+	"testing"
+)
+
+type testPush struct {
+	Method string
+}
+
+func (this testPush) PushMethod() string {
+	return this.Method
+}
+
+func newReplayTestUser(replaySize int) (onlineUser *OnlineUser, conn *Connection) {
+	cfg := configs.Default()
+	cfg.ReplayBufferSize = replaySize
+	cfg.SendBufferSize = 100
+
+	activeOrg := &ActiveOrg{
+		OrgId:       bson.NewObjectId().Hex(),
+		OnlineUsers: make(map[bson.ObjectId]*OnlineUser),
+		CloseSign:   make(chan bool, 1),
+		Config:      cfg,
+	}
+	onlineUser, conn, _ = activeOrg.GetOrInitOnlineUser(&users.User{Id: bson.NewObjectId()}, nil, NO_RESUME)
+	return
+}
+
+// The methods of the queued pushes, with the seq of the numbered ones
+func popPushes(conn *Connection) (methods []string, seqs []uint64) {
+	for _, msg := range popAll(conn.Queue) {
+		switch push := msg.(type) {
+		case *SequencedPush:
+			methods = append(methods, push.PushMethod())
+			seqs = append(seqs, push.Seq)
+		case MethodPush:
+			methods = append(methods, push.PushMethod())
+		}
+	}
+	return
+}
+
+func lastSync(t *testing.T, conn *Connection) SyncNotification {
+	msgs := popAll(conn.Queue)
+	if len(msgs) == 0 {
+		t.Fatal("expected a sync push")
+	}
+	sync, ok := msgs[len(msgs)-1].(SyncNotification)
+	if !ok {
+		t.Fatalf("expected the sync push last, got %+v", msgs)
+	}
+	return sync
+}
+
+func TestSendReplyNumbersThePushes(t *testing.T) {
+	onlineUser, conn := newReplayTestUser(10)
+	synced := lastSync(t, conn)
+
+	onlineUser.SendReply(testPush{"A"})
+	onlineUser.SendReply(testPush{"B"})
+
+	methods, seqs := popPushes(conn)
+	if len(seqs) != 2 || seqs[0] != synced.Seq+1 || seqs[1] != synced.Seq+2 {
+		t.Fatalf("expected the seqs after %d, got %v %v", synced.Seq, methods, seqs)
+	}
+}
+
+func TestReplayBufferIsBounded(t *testing.T) {
+	onlineUser, _ := newReplayTestUser(3)
+	for i := 0; i < 5; i++ {
+		onlineUser.SendReply(testPush{"A"})
+	}
+
+	onlineUser.Lock.Lock()
+	defer onlineUser.Lock.Unlock()
+	if len(onlineUser.replay) != 3 || onlineUser.replay[2].Seq != onlineUser.lastSeq {
+		t.Fatalf("expected the 3 latest pushes kept, got %d", len(onlineUser.replay))
+	}
+}
+
+func TestResume(t *testing.T) {
+	onlineUser, conn := newReplayTestUser(3)
+	start := lastSync(t, conn).Seq
+	for _, method := range []string{"A", "B", "C", "D", "E"} {
+		onlineUser.SendReply(testPush{method})
+	}
+	popAll(conn.Queue)
+
+	// The buffer keeps C, D and E: start+3 to start+5
+	cases := []struct {
+		name    string
+		resume  int64
+		methods []string
+		sync    string
+	}{
+		{"not resuming", NO_RESUME, nil, SERVER_SYNCED},
+		{"up to date", int64(start + 5), nil, SERVER_SYNCED},
+		{"missed the last one", int64(start + 4), []string{"E"}, SERVER_SYNCED},
+		{"missed all the kept ones", int64(start + 2), []string{"C", "D", "E"}, SERVER_SYNCED},
+		{"missed one gone", int64(start + 1), nil, SERVER_RESYNC_REQUIRED},
+		{"from an older user", 0, nil, SERVER_RESYNC_REQUIRED},
+		{"from the future", int64(start + 6), nil, SERVER_RESYNC_REQUIRED},
+	}
+
+	for _, c := range cases {
+		_, resumed, _ := onlineUser.InActivedOrg.GetOrInitOnlineUser(onlineUser.User, nil, c.resume)
+		methods, _ := popPushes(resumed)
+		if len(methods) == 0 {
+			t.Errorf("%s: expected a sync push", c.name)
+			continue
+		}
+
+		replayed, sync := methods[:len(methods)-1], methods[len(methods)-1]
+		if sync != c.sync || len(replayed) != len(c.methods) {
+			t.Errorf("%s: expected %v then %s, got %v", c.name, c.methods, c.sync, methods)
+			continue
+		}
+		for i := range replayed {
+			if replayed[i] != c.methods[i] {
+				t.Errorf("%s: expected %v then %s, got %v", c.name, c.methods, c.sync, methods)
+				break
+			}
+		}
+	}
+}
+
+func TestResumeWithoutReplayBuffer(t *testing.T) {
+	onlineUser, conn := newReplayTestUser(0)
+	start := lastSync(t, conn).Seq
+	onlineUser.SendReply(testPush{"A"})
+
+	_, resumed, _ := onlineUser.InActivedOrg.GetOrInitOnlineUser(onlineUser.User, nil, int64(start))
+	if sync := lastSync(t, resumed); sync.Method != SERVER_RESYNC_REQUIRED {
+		t.Fatalf("expected a resync, got %+v", sync)
+	}
+
+	_, resumed, _ = onlineUser.InActivedOrg.GetOrInitOnlineUser(onlineUser.User, nil, int64(start+1))
+	if sync := lastSync(t, resumed); sync.Method != SERVER_SYNCED || sync.Seq != start+1 {
+		t.Fatalf("expected synced at %d, got %+v", start+1, sync)
+	}
+}
+
+// The topic pushes aren't numbered, they go to the subscribers only
+func TestTopicPushesAreEphemeral(t *testing.T) {
+	onlineUser, conn := newReplayTestUser(10)
+	lastSync(t, conn)
+	conn.Subscribe("entry:1")
+
+	onlineUser.InActivedOrg.PushToSubscribers("entry:1", testPush{"Entry.Updated"})
+	methods, seqs := popPushes(conn)
+	if len(methods) != 1 || len(seqs) != 0 {
+		t.Fatalf("expected one push without seq, got %v %v", methods, seqs)
+	}
+
+	onlineUser.Lock.Lock()
+	defer onlineUser.Lock.Unlock()
+	if len(onlineUser.replay) != 0 {
+		t.Fatal("expected nothing kept for replaying")
+	}
+}
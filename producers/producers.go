@@ -0,0 +1,66 @@
+package producers
+
+import (
+	"github.com/bitly/go-nsq"
+	"sync"
+)
+
+// Publishes the messages the other qortex services consume, e.g. the offline users
+type Producer interface {
+	Publish(topic string, body []byte) error
+	Stop()
+}
+
+type NsqProducer struct {
+	writer *nsq.Writer
+}
+
+func NewNsqProducer(nsqdAddr string) *NsqProducer {
+	return &NsqProducer{writer: nsq.NewWriter(nsqdAddr)}
+}
+
+func (this *NsqProducer) Publish(topic string, body []byte) (err error) {
+	_, _, err = this.writer.Publish(topic, body)
+	return
+}
+
+func (this *NsqProducer) Stop() {
+	this.writer.Stop()
+}
+
+type FakeMessage struct {
+	Topic string
+	Body  []byte
+}
+
+// Keeps the published messages in memory, for the tests and the development
+type FakeProducer struct {
+	messages []FakeMessage
+	lock     sync.Mutex
+}
+
+func NewFakeProducer() *FakeProducer {
+	return new(FakeProducer)
+}
+
+func (this *FakeProducer) Publish(topic string, body []byte) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.messages = append(this.messages, FakeMessage{Topic: topic, Body: body})
+	return nil
+}
+
+func (this *FakeProducer) Stop() {}
+
+// Snapshot of the published messages
+func (this *FakeProducer) Messages() []FakeMessage {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return append([]FakeMessage{}, this.messages...)
+}
+
+func (this *FakeProducer) Reset() {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.messages = nil
+}
@@ -0,0 +1,282 @@
+package services
+
+import (
+	"encoding/json"
+	"github.com/kobeld/qortex-realtime/cluster"
+	"github.com/kobeld/qortex-realtime/models/ws"
+	"github.com/theplant/qortex/utils"
+	"labix.org/v2/mgo/bson"
+	"time"
+)
+
+// Nil when running as a single node
+var (
+	backplane cluster.Backplane
+	presence  *cluster.Presence
+)
+
+// The counter push forwarded to the node holding the user's websocket
+type counterPushPayload struct {
+	GroupId    string
+	Scope      string
+	RootId     string
+	NewEntryId string
+}
+
+// The most users announced in one refresh message
+const PRESENCE_REFRESH_BATCH_SIZE = 500
+
+// Join the cluster: share the presence of the local users with the other
+// nodes and take the pushes they forward to our users.
+func InitCluster(bp cluster.Backplane) {
+	backplane = bp
+	presence = cluster.NewPresence(config.PresenceTTL.Duration)
+	backplane.Subscribe(handleClusterMessage)
+
+	// Keep the presence of the local users fresh on the other nodes,
+	// and find out the users of the nodes gone silent
+	go func() {
+		for _ = range time.Tick(config.PresenceTTL.Duration / 3) {
+			if IsShuttingDown() {
+				return
+			}
+			refreshPresence()
+			sweepPresence()
+		}
+	}()
+}
+
+func LeaveCluster() {
+	if backplane == nil {
+		return
+	}
+
+	publishToCluster(&cluster.Message{Kind: cluster.KIND_NODE_DOWN})
+	if err := backplane.Close(); err != nil {
+		utils.PrintStackAndError(err)
+	}
+}
+
+// The online announcements carry the state of the user on this node
+func announcePresence(onlineUser *ws.OnlineUser, kind string) {
+	if backplane == nil {
+		return
+	}
+
+	payload, err := json.Marshal(localStatus(onlineUser))
+	if err != nil {
+		utils.PrintStackAndError(err)
+		return
+	}
+
+	publishToCluster(&cluster.Message{
+		Kind:    kind,
+		OrgId:   onlineUser.InActivedOrg.OrgId,
+		UserId:  onlineUser.User.Id.Hex(),
+		Payload: payload,
+	})
+}
+
+// Announce the local users in batches. Sent even without users, so the
+// other nodes know this one is alive.
+func refreshPresence() {
+	announcements := []cluster.Announcement{}
+	for _, onlineUser := range allOnlineUsers() {
+		announcements = append(announcements, cluster.Announcement{
+			OrgId:  onlineUser.InActivedOrg.OrgId,
+			UserId: onlineUser.User.Id.Hex(),
+			Status: localStatus(onlineUser),
+		})
+	}
+
+	for {
+		batch := announcements
+		if len(batch) > PRESENCE_REFRESH_BATCH_SIZE {
+			batch = batch[:PRESENCE_REFRESH_BATCH_SIZE]
+		}
+		announcements = announcements[len(batch):]
+
+		payload, err := json.Marshal(batch)
+		if err != nil {
+			utils.PrintStackAndError(err)
+			return
+		}
+		publishToCluster(&cluster.Message{Kind: cluster.KIND_REFRESH, Payload: payload})
+
+		if len(announcements) == 0 {
+			return
+		}
+	}
+}
+
+// The users whose node stopped refreshing them went offline there. The
+// smallest living node id puts them into the offline queue, that node is gone.
+func sweepPresence() {
+	queuing := isFirstNode()
+	for _, entry := range presence.Expire() {
+		user := PresenceUser{UserId: entry.UserId, OrgId: entry.OrgId}
+		remotePresenceLeft(user, entry.Status, queuing)
+	}
+}
+
+func isFirstNode() bool {
+	for _, nodeId := range presence.Nodes() {
+		if nodeId < config.NodeId {
+			return false
+		}
+	}
+	return true
+}
+
+// Whether the user is online on another node
+func isOnlineInCluster(userId bson.ObjectId) bool {
+	if backplane == nil {
+		return false
+	}
+	return len(presence.Locate(userId.Hex())) > 0
+}
+
+// Forward the counter push to the other nodes where the user is online
+func forwardCounterPush(userId bson.ObjectId, groupId string, newMessage ws.NewMessage) {
+	payload, err := json.Marshal(counterPushPayload{
+		GroupId:    groupId,
+		Scope:      newMessage.Scope,
+		RootId:     newMessage.RootId,
+		NewEntryId: newMessage.EntryId,
+	})
+	if err != nil {
+		utils.PrintStackAndError(err)
+		return
+	}
+
+	for _, loc := range presence.Locate(userId.Hex()) {
+		publishToCluster(&cluster.Message{
+			Kind:    cluster.KIND_COUNTER,
+			To:      loc.NodeId,
+			OrgId:   loc.OrgId,
+			UserId:  userId.Hex(),
+			Payload: payload,
+		})
+	}
+}
+
+func publishToCluster(msg *cluster.Message) {
+	msg.NodeId = config.NodeId
+	if err := backplane.Publish(msg); err != nil {
+		utils.PrintStackAndError(err)
+	}
+}
+
+func handleClusterMessage(msg *cluster.Message) {
+	// Our own messages, or the ones targeting another node
+	if msg.NodeId == config.NodeId || (msg.To != "" && msg.To != config.NodeId) {
+		return
+	}
+
+	loc := cluster.Location{NodeId: msg.NodeId, OrgId: msg.OrgId}
+	user := PresenceUser{UserId: msg.UserId, OrgId: msg.OrgId}
+
+	switch msg.Kind {
+	case cluster.KIND_ONLINE:
+		status := cluster.Status{}
+		if err := json.Unmarshal(msg.Payload, &status); err != nil {
+			utils.PrintStackAndError(err)
+			return
+		}
+		touchRemotePresence(user, loc, status)
+
+	case cluster.KIND_REFRESH:
+		presence.TouchNode(msg.NodeId)
+
+		var announcements []cluster.Announcement
+		if err := json.Unmarshal(msg.Payload, &announcements); err != nil {
+			utils.PrintStackAndError(err)
+			return
+		}
+		for _, a := range announcements {
+			loc := cluster.Location{NodeId: msg.NodeId, OrgId: a.OrgId}
+			touchRemotePresence(PresenceUser{UserId: a.UserId, OrgId: a.OrgId}, loc, a.Status)
+		}
+
+	case cluster.KIND_OFFLINE:
+		before, _ := presenceStatus(user)
+		presence.Remove(msg.UserId, loc)
+		// Put into the queue by that node, it may come back here
+		remotePresenceLeft(user, before, false)
+
+	case cluster.KIND_NODE_DOWN:
+		presence.RemoveNode(msg.NodeId)
+
+	case cluster.KIND_COUNTER:
+		onlineUser := findLocalOnlineUser(msg.OrgId, msg.UserId)
+		if onlineUser == nil {
+			return
+		}
+
+		payload := new(counterPushPayload)
+		if err := json.Unmarshal(msg.Payload, payload); err != nil {
+			utils.PrintStackAndError(err)
+			return
+		}
+		newMessage := ws.NewMessage{Scope: payload.Scope, RootId: payload.RootId, EntryId: payload.NewEntryId}
+		queueCounterPush(onlineUser, payload.GroupId, newMessage)
+
+	case cluster.KIND_TOPIC:
+		handleTopicMessage(msg)
+	}
+}
+
+// Also the periodic refresh, only push when the user wasn't online
+// anywhere or the aggregated state changes
+func touchRemotePresence(user PresenceUser, loc cluster.Location, status cluster.Status) {
+	before, wasOnline := presenceStatus(user)
+	presence.Touch(user.UserId, loc, status)
+	after, _ := presenceStatus(user)
+
+	user.State, user.LastActiveAt = after.State, after.LastActiveAt
+	if !wasOnline {
+		// The node it came back to cancels the queued digest
+		markOfflineUser(user.OrgId, user.UserId, false)
+		pushPresence(PRESENCE_ONLINE, user)
+	} else if before.State != after.State {
+		pushPresence(PRESENCE_STATE, user)
+	}
+}
+
+// A location of the user is gone, before is the status with it. Put the user
+// into the offline queue if queuing, otherwise only remember it was put.
+func remotePresenceLeft(user PresenceUser, before cluster.Status, queuing bool) {
+	after, online := presenceStatus(user)
+	if online {
+		before = mergeStatuses([]cluster.Status{before, after})
+		if before.State != after.State {
+			user.State, user.LastActiveAt = after.State, after.LastActiveAt
+			pushPresence(PRESENCE_STATE, user)
+		}
+		return
+	}
+
+	user.LastActiveAt = before.LastActiveAt
+	pushPresence(PRESENCE_OFFLINE, user)
+
+	if queuing {
+		queueOfflineUser(user.OrgId, user.UserId, before.LastActiveAt)
+	} else {
+		markOfflineUser(user.OrgId, user.UserId, true)
+	}
+}
+
+// Find the user connected to this node, without activating the org
+func findLocalOnlineUser(orgIdHex, userIdHex string) *ws.OnlineUser {
+	if !bson.IsObjectIdHex(userIdHex) {
+		return nil
+	}
+
+	activeOrg := findLocalActiveOrg(orgIdHex)
+	if activeOrg == nil {
+		return nil
+	}
+
+	onlineUser, _ := activeOrg.GetOnlineUserById(bson.ObjectIdHex(userIdHex))
+	return onlineUser
+}
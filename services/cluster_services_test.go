@@ -0,0 +1,220 @@
+package services
+
+import (
+	"encoding/json"
+	"github.com/kobeld/qortex-realtime/cluster"
+	"github.com/kobeld/qortex-realtime/models/ws"
+	"labix.org/v2/mgo/bson"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Another node on the hub, keeping what it gets from this one
+type remoteNode struct {
+	id       string
+	bp       cluster.Backplane
+	messages []*cluster.Message
+	lock     sync.Mutex
+}
+
+func (this *remoteNode) handle(msg *cluster.Message) {
+	if msg.NodeId == this.id || (msg.To != "" && msg.To != this.id) {
+		return
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.messages = append(this.messages, msg)
+}
+
+func (this *remoteNode) received(kind string) (messages []*cluster.Message) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	for _, msg := range this.messages {
+		if msg.Kind == kind {
+			messages = append(messages, msg)
+		}
+	}
+	return
+}
+
+func (this *remoteNode) publish(msg *cluster.Message) {
+	msg.NodeId = this.id
+	this.bp.Publish(msg)
+}
+
+// This node joins a memory hub as "a", without the presence refresh of InitCluster
+func joinTestCluster() (hub *cluster.MemoryHub, restore func()) {
+	oldBackplane, oldPresence, oldNodeId := backplane, presence, config.NodeId
+
+	hub = cluster.NewMemoryHub()
+	config.NodeId = "a"
+	backplane = hub.Backplane()
+	presence = cluster.NewPresence(time.Minute)
+	backplane.Subscribe(handleClusterMessage)
+
+	return hub, func() {
+		backplane, presence, config.NodeId = oldBackplane, oldPresence, oldNodeId
+	}
+}
+
+func newRemoteNode(hub *cluster.MemoryHub, id string) *remoteNode {
+	node := &remoteNode{id: id, bp: hub.Backplane()}
+	node.bp.Subscribe(node.handle)
+	return node
+}
+
+func TestClusterOverMemoryHub(t *testing.T) {
+	hub, restore := joinTestCluster()
+	defer restore()
+	nodeB := newRemoteNode(hub, "b")
+
+	activeOrg := newTestActiveOrg()
+	defer removeTestActiveOrg(activeOrg)
+
+	_, watcherConn := newTestUser(activeOrg)
+	watcherConn.Subscribe(PRESENCE_TOPIC)
+
+	// A user comes online on node b
+	remoteUserId := bson.NewObjectId()
+	payload, _ := json.Marshal(cluster.Status{State: ws.STATE_ACTIVE, LastActiveAt: time.Now()})
+	nodeB.publish(&cluster.Message{Kind: cluster.KIND_ONLINE, OrgId: activeOrg.OrgId, UserId: remoteUserId.Hex(), Payload: payload})
+
+	if !isOnlineInCluster(remoteUserId) {
+		t.Fatal("expected the user online in the cluster")
+	}
+	if methods := popPushes(watcherConn); len(methods) != 1 || methods[0] != PRESENCE_ONLINE {
+		t.Fatalf("expected Presence.Online on this node, got %v", methods)
+	}
+
+	// Its counter pushes go to node b only
+	newMessage := ws.NewMessage{Scope: groupTopic(bson.NewObjectId().Hex()), RootId: "root", EntryId: "comment"}
+	forwardCounterPush(remoteUserId, "group", newMessage)
+
+	counters := nodeB.received(cluster.KIND_COUNTER)
+	if len(counters) != 1 || counters[0].To != "b" || counters[0].UserId != remoteUserId.Hex() {
+		t.Fatalf("expected one counter push to node b, got %+v", counters)
+	}
+	forwarded := new(counterPushPayload)
+	json.Unmarshal(counters[0].Payload, forwarded)
+	if forwarded.Scope != newMessage.Scope || forwarded.RootId != "root" || forwarded.NewEntryId != "comment" {
+		t.Fatalf("unexpected counter push %+v", forwarded)
+	}
+
+	// Node b goes down
+	nodeB.publish(&cluster.Message{Kind: cluster.KIND_NODE_DOWN})
+	if isOnlineInCluster(remoteUserId) {
+		t.Fatal("expected the user gone with node b")
+	}
+}
+
+func TestClusterCounterPushToLocalUser(t *testing.T) {
+	hub, restore := joinTestCluster()
+	defer restore()
+	nodeB := newRemoteNode(hub, "b")
+
+	activeOrg := newTestActiveOrg()
+	defer removeTestActiveOrg(activeOrg)
+	onlineUser, _ := newTestUser(activeOrg)
+
+	payload, _ := json.Marshal(counterPushPayload{GroupId: "group", Scope: "group:a", RootId: "root", NewEntryId: "comment"})
+	nodeB.publish(&cluster.Message{Kind: cluster.KIND_COUNTER, To: "a", OrgId: activeOrg.OrgId, UserId: onlineUser.User.Id.Hex(), Payload: payload})
+
+	// Another node's push is ignored
+	nodeB.publish(&cluster.Message{Kind: cluster.KIND_COUNTER, To: "c", OrgId: activeOrg.OrgId, UserId: onlineUser.User.Id.Hex(), Payload: payload})
+
+	if number := onlineUser.NewMessageNumber(); number != 1 {
+		t.Fatalf("expected 1 new message, got %d", number)
+	}
+	if number := onlineUser.DeleteNewMessageRoot("root"); number != 0 {
+		t.Fatalf("expected the comment read with its root, got %d left", number)
+	}
+}
+
+func TestOnlineUsersLookupDoesNotActivateTheOrg(t *testing.T) {
+	orgIdHex := bson.NewObjectId().Hex()
+	if len(GetOnlineUsersByOrgIds([]string{orgIdHex})) != 0 || findLocalActiveOrg(orgIdHex) != nil {
+		t.Fatal("expected no online users and the org not activated")
+	}
+}
+
+// One refresh message with all the local users, or an empty one telling the node is alive
+func TestPresenceRefreshBatched(t *testing.T) {
+	hub, restore := joinTestCluster()
+	defer restore()
+	nodeB := newRemoteNode(hub, "b")
+
+	refreshPresence()
+	refreshes := nodeB.received(cluster.KIND_REFRESH)
+	if len(refreshes) != 1 || string(refreshes[0].Payload) != "[]" {
+		t.Fatalf("expected an empty refresh, got %+v", refreshes)
+	}
+
+	activeOrg := newTestActiveOrg()
+	defer removeTestActiveOrg(activeOrg)
+	newTestUser(activeOrg)
+	newTestUser(activeOrg)
+
+	refreshPresence()
+	refreshes = nodeB.received(cluster.KIND_REFRESH)
+	var announcements []cluster.Announcement
+	json.Unmarshal(refreshes[len(refreshes)-1].Payload, &announcements)
+	if len(refreshes) != 2 || len(announcements) != 2 {
+		t.Fatalf("expected one refresh with the 2 users, got %d refreshes, %+v", len(refreshes), announcements)
+	}
+}
+
+// Node b stops refreshing its user, the smallest living node queues the offline digest
+func TestExpiredPresenceGoesOffline(t *testing.T) {
+	cases := []struct {
+		name     string
+		nodeZero bool // A living node before "a"
+		statuses []string
+	}{
+		{"first node", false, []string{OFFLINE_STATUS_OFFLINE}},
+		{"not first node", true, nil},
+	}
+
+	for _, c := range cases {
+		hub, restore := joinTestCluster()
+		presence = cluster.NewPresence(30 * time.Millisecond)
+		producer, restoreProducer := useFakeProducer()
+		nodeB, nodeZero := newRemoteNode(hub, "b"), newRemoteNode(hub, "0")
+
+		activeOrg := newTestActiveOrg()
+		_, watcherConn := newTestUser(activeOrg)
+		watcherConn.Subscribe(PRESENCE_TOPIC)
+
+		remoteUserId := bson.NewObjectId().Hex()
+		announcements, _ := json.Marshal([]cluster.Announcement{{
+			OrgId:  activeOrg.OrgId,
+			UserId: remoteUserId,
+			Status: cluster.Status{State: ws.STATE_ACTIVE, LastActiveAt: time.Now()},
+		}})
+		nodeB.publish(&cluster.Message{Kind: cluster.KIND_REFRESH, Payload: announcements})
+		if methods := popPushes(watcherConn); len(methods) != 1 || methods[0] != PRESENCE_ONLINE {
+			t.Fatalf("%s: expected Presence.Online, got %v", c.name, methods)
+		}
+
+		time.Sleep(40 * time.Millisecond)
+		if c.nodeZero {
+			nodeZero.publish(&cluster.Message{Kind: cluster.KIND_REFRESH, Payload: json.RawMessage("[]")})
+		}
+		sweepPresence()
+
+		if methods := popPushes(watcherConn); len(methods) != 1 || methods[0] != PRESENCE_OFFLINE {
+			t.Errorf("%s: expected Presence.Offline, got %v", c.name, methods)
+		}
+		if statuses := publishedStatuses(t, producer); len(statuses) != len(c.statuses) {
+			t.Errorf("%s: expected %v queued, got %v", c.name, c.statuses, statuses)
+		}
+		// Either way the node the user comes back to cancels the digest
+		if !markOfflineUser(activeOrg.OrgId, remoteUserId, false) {
+			t.Errorf("%s: expected the user marked offline", c.name)
+		}
+
+		removeTestActiveOrg(activeOrg)
+		restoreProducer()
+		restore()
+	}
+}
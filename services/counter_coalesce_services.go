@@ -0,0 +1,107 @@
+package services
+
+import (
+	"github.com/kobeld/qortex-realtime/models/ws"
+	"github.com/theplant/qortex/services"
+	"sync"
+	"time"
+)
+
+// The Counter.Refresh/NewArrived pushes waiting for the coalesce window to pass
+type pendingCounterPush struct {
+	groupIds map[string]bool
+	entryIds []string
+}
+
+func (this *pendingCounterPush) add(groupId, entryId string) {
+	if groupId != "" {
+		this.groupIds[groupId] = true
+	}
+	this.entryIds = append(this.entryIds, nonEmpty(entryId)...)
+}
+
+// The group of the events, empty if they span several
+func (this *pendingCounterPush) groupId() string {
+	if len(this.groupIds) != 1 {
+		return ""
+	}
+	for groupId := range this.groupIds {
+		return groupId
+	}
+	return ""
+}
+
+// Replaced in the tests
+var userCountData = services.UserCountData
+
+var (
+	pendingMu            sync.Mutex
+	pendingCounterPushes = make(map[*ws.OnlineUser]*pendingCounterPush)
+)
+
+// Merge the counter pushes of a user within config.RefreshCoalesceWindow,
+// so a burst of events only costs one MyCount computation and one push.
+// A newMessage without EntryId means a plain Counter.Refresh.
+func queueCounterPush(onlineUser *ws.OnlineUser, groupId string, newMessage ws.NewMessage) {
+	newEntryId := newMessage.EntryId
+	if newEntryId != "" {
+		onlineUser.AddNewMessageId(newMessage)
+	}
+
+	window := config.RefreshCoalesceWindow.Duration
+	if window <= 0 {
+		pending := &pendingCounterPush{groupIds: make(map[string]bool)}
+		pending.add(groupId, newEntryId)
+		pushCounter(onlineUser, pending)
+		return
+	}
+
+	pendingMu.Lock()
+	defer pendingMu.Unlock()
+
+	pending, exist := pendingCounterPushes[onlineUser]
+	if !exist {
+		pending = &pendingCounterPush{groupIds: make(map[string]bool)}
+		pendingCounterPushes[onlineUser] = pending
+
+		time.AfterFunc(window, func() {
+			pendingMu.Lock()
+			delete(pendingCounterPushes, onlineUser)
+			pendingMu.Unlock()
+
+			pushCounter(onlineUser, pending)
+		})
+	}
+
+	pending.add(groupId, newEntryId)
+}
+
+// Nothing to compute for a user gone offline or killed during the window
+func pushCounter(onlineUser *ws.OnlineUser, pending *pendingCounterPush) {
+	if !onlineUser.IsOnline() {
+		return
+	}
+
+	reply := CountNotification{
+		Method:  COUNTER_REFRESH,
+		GroupId: pending.groupId(),
+		MyCount: userCountData(onlineUser.AllDBs(), onlineUser.User),
+	}
+
+	if len(pending.entryIds) > 0 {
+		reply.Method = COUNTER_NEW_ARRIVED
+		reply.NewEntry = true
+		reply.EntryId = pending.entryIds[len(pending.entryIds)-1]
+		reply.EntryIds = pending.entryIds
+		reply.NewMessageNumber = onlineUser.NewMessageNumber()
+		reply.NewCounts = onlineUser.NewMessageCounts()
+	}
+	onlineUser.SendReply(reply)
+}
+
+func nonEmpty(id string) []string {
+	if id == "" {
+		return nil
+	}
+	return []string{id}
+}
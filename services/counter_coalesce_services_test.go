@@ -0,0 +1,121 @@
+package services
+
+import (
+	"github.com/kobeld/qortex-realtime/models/ws"
+	"github.com/sunfmin/mgodb"
+	"github.com/theplant/qortex/users"
+	"github.com/theplant/qortexapi"
+	"reflect"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Counts the MyCount computations until restored
+func countUserData() (computed *int32, restore func()) {
+	computed = new(int32)
+	old := userCountData
+	userCountData = func(dbs []*mgodb.Database, u *users.User) *qortexapi.MyCount {
+		atomic.AddInt32(computed, 1)
+		return nil
+	}
+	return computed, func() { userCountData = old }
+}
+
+func useCoalesceWindow(window time.Duration) (restore func()) {
+	old := config.RefreshCoalesceWindow.Duration
+	config.RefreshCoalesceWindow.Duration = window
+	return func() { config.RefreshCoalesceWindow.Duration = old }
+}
+
+// The counter pushes queued on the connection, taking them out of the queue
+func popCounterPushes(conn *ws.Connection) (pushes []CountNotification) {
+	for conn.Queue.Len() > 0 {
+		msg, _ := conn.Queue.Pop()
+		if push, ok := msg.(*ws.SequencedPush); ok {
+			if count, ok := push.Push.(CountNotification); ok {
+				pushes = append(pushes, count)
+			}
+		}
+	}
+	return
+}
+
+func TestCounterPushesCoalesced(t *testing.T) {
+	defer useCoalesceWindow(20 * time.Millisecond)()
+	computed, restore := countUserData()
+	defer restore()
+
+	activeOrg := newTestActiveOrg()
+	defer removeTestActiveOrg(activeOrg)
+	onlineUser, conn := newTestUser(activeOrg)
+
+	cases := []struct {
+		name     string
+		groupIds []string
+		entryIds []string
+		method   string
+		groupId  string
+	}{
+		{"new arrivals", []string{"g1", "g1", "g1"}, []string{"e1", "e2", "e3"}, COUNTER_NEW_ARRIVED, "g1"},
+		{"refreshes", []string{"g1", "g1"}, []string{"", ""}, COUNTER_REFRESH, "g1"},
+		{"several groups", []string{"g1", "g2", "g1"}, []string{"e4", "", "e5"}, COUNTER_NEW_ARRIVED, ""},
+	}
+
+	for _, c := range cases {
+		atomic.StoreInt32(computed, 0)
+		for i, groupId := range c.groupIds {
+			queueCounterPush(onlineUser, groupId, ws.NewMessage{Scope: groupTopic(groupId), EntryId: c.entryIds[i]})
+		}
+
+		var pushes []CountNotification
+		waitUntil(t, c.name+" pushed", func() bool {
+			pushes = append(pushes, popCounterPushes(conn)...)
+			return len(pushes) > 0
+		})
+		time.Sleep(40 * time.Millisecond)
+		pushes = append(pushes, popCounterPushes(conn)...)
+
+		if n := atomic.LoadInt32(computed); len(pushes) != 1 || n != 1 {
+			t.Fatalf("%s: expected one push and one computation, got %d pushes and %d", c.name, len(pushes), n)
+		}
+
+		push := pushes[0]
+		if push.Method != c.method || push.GroupId != c.groupId {
+			t.Errorf("%s: expected %s in %q, got %s in %q", c.name, c.method, c.groupId, push.Method, push.GroupId)
+		}
+		var entryIds []string
+		for _, id := range c.entryIds {
+			entryIds = append(entryIds, nonEmpty(id)...)
+		}
+		if !reflect.DeepEqual(push.EntryIds, entryIds) {
+			t.Errorf("%s: expected the entries %v, got %v", c.name, entryIds, push.EntryIds)
+		}
+	}
+}
+
+func TestCounterPushSkippedWhenOffline(t *testing.T) {
+	defer useCoalesceWindow(20 * time.Millisecond)()
+	computed, restore := countUserData()
+	defer restore()
+
+	activeOrg := newTestActiveOrg()
+	defer removeTestActiveOrg(activeOrg)
+	onlineUser, conn := newTestUser(activeOrg)
+
+	queueCounterPush(onlineUser, "g1", ws.NewMessage{})
+	onlineUser.Lock.Lock()
+	onlineUser.Closing = true // No grace period timer
+	onlineUser.Lock.Unlock()
+	onlineUser.KillConnection(conn)
+
+	waitUntil(t, "the window to pass", func() bool {
+		pendingMu.Lock()
+		defer pendingMu.Unlock()
+		return pendingCounterPushes[onlineUser] == nil
+	})
+	time.Sleep(10 * time.Millisecond)
+	if n := atomic.LoadInt32(computed); n != 0 {
+		t.Fatalf("expected nothing computed for the offline user, got %d", n)
+	}
+}
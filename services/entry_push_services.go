@@ -0,0 +1,63 @@
+package services
+
+import (
+	"github.com/theplant/qortex/nsqproducers"
+	"github.com/theplant/qortexapi"
+)
+
+const (
+	ENTRY_UPDATED = "Entry.Updated"
+	ENTRY_DELETED = "Entry.Deleted"
+	ENTRY_LIKED   = "Entry.Liked"
+)
+
+// Pushed to the connections viewing the entry, its root entry, or its group
+// (conversation), so the pages update in place without refetching.
+// Liked tells whether Entry.Liked is a like or a removed like.
+type EntryNotification struct {
+	Method string
+	Entry  *qortexapi.Entry
+	Liked  bool
+}
+
+func (this EntryNotification) PushMethod() string {
+	return this.Method
+}
+
+// The connections only get the topics through Topic.Subscribe, Typing.Start
+// and Counter.ReadEntry, all of them check the access first
+func pushEntryToViewers(entryTopicData *nsqproducers.EntryTopicData) {
+	apiEntry := entryTopicData.ApiEntry
+	if apiEntry == nil {
+		return
+	}
+
+	reply := EntryNotification{Entry: apiEntry}
+	switch entryTopicData.Status {
+	case nsqproducers.TOPIC_STATUS_CREATE, nsqproducers.TOPIC_STATUS_UPDATE:
+		reply.Method = ENTRY_UPDATED
+	case nsqproducers.TOPIC_STATUS_DELETE:
+		reply.Method = ENTRY_DELETED
+	case nsqproducers.TOPIC_STATUS_LIKE, nsqproducers.TOPIC_STATUS_REMOVE_LIKE:
+		reply.Method = ENTRY_LIKED
+		reply.Liked = (entryTopicData.Status == nsqproducers.TOPIC_STATUS_LIKE)
+	default:
+		return
+	}
+
+	pushToTopics(entryTopicData.OrgId, entryTopics(apiEntry), reply, "")
+}
+
+func entryTopics(apiEntry *qortexapi.Entry) (topics []string) {
+	topics = append(topics, entryTopic(apiEntry.Id))
+	if apiEntry.RootId != "" && apiEntry.RootId != apiEntry.Id {
+		topics = append(topics, entryTopic(apiEntry.RootId))
+	}
+
+	if apiEntry.ConversationId != "" {
+		topics = append(topics, conversationTopic(apiEntry.ConversationId))
+	} else if apiEntry.GroupId != "" {
+		topics = append(topics, groupTopic(apiEntry.GroupId))
+	}
+	return
+}
@@ -0,0 +1,56 @@
+package services
+
+import (
+	"github.com/theplant/qortex/nsqproducers"
+	"github.com/theplant/qortexapi"
+	"labix.org/v2/mgo/bson"
+	"testing"
+)
+
+func TestEntryPushSkipsNonMembers(t *testing.T) {
+	activeOrg := newTestActiveOrg()
+	defer removeTestActiveOrg(activeOrg)
+
+	member, memberConn := newTestUser(activeOrg)
+	_, strangerConn := newTestUser(activeOrg)
+	defer useTopicGuard(&fakeTopicGuard{allowed: map[bson.ObjectId]bool{member.User.Id: true}})()
+
+	entryId := bson.NewObjectId().Hex()
+	topic := entryTopic(entryId)
+
+	var ok bool
+	input := &TopicInput{Topic: topic}
+	input.setContext(newRpcContext(memberConn, "Topic.Subscribe"))
+	if err := new(Topic).Subscribe(input, &ok); err != nil {
+		t.Fatalf("member subscribing: %s", err)
+	}
+
+	input = &TopicInput{Topic: topic}
+	input.setContext(newRpcContext(strangerConn, "Topic.Subscribe"))
+	if err := new(Topic).Subscribe(input, &ok); err != ErrTopicForbidden {
+		t.Fatalf("non-member subscribing: want ErrTopicForbidden, got %v", err)
+	}
+
+	// Typing in it doesn't make the non-member a viewer either
+	typing := &TypingInput{EntryId: entryId}
+	typing.setContext(newRpcContext(strangerConn, "Typing.Start"))
+	if err := new(Typing).Start(typing, &ok); err != ErrTopicForbidden {
+		t.Fatalf("non-member typing: want ErrTopicForbidden, got %v", err)
+	}
+	if strangerConn.IsSubscribed(topic) {
+		t.Fatal("non-member became a viewer")
+	}
+
+	pushEntryToViewers(&nsqproducers.EntryTopicData{
+		OrgId:    activeOrg.OrgId,
+		Status:   nsqproducers.TOPIC_STATUS_UPDATE,
+		ApiEntry: &qortexapi.Entry{Id: entryId},
+	})
+
+	if methods := popPushes(memberConn); len(methods) != 1 || methods[0] != ENTRY_UPDATED {
+		t.Errorf("member got %v, want [%s]", methods, ENTRY_UPDATED)
+	}
+	if methods := popPushes(strangerConn); len(methods) != 0 {
+		t.Errorf("non-member got %v, want nothing", methods)
+	}
+}
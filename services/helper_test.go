@@ -0,0 +1,85 @@
+package services
+
+import (
+	"github.com/kobeld/qortex-realtime/models/ws"
+	"github.com/theplant/qortex/organizations"
+	"github.com/theplant/qortex/users"
+	"labix.org/v2/mgo/bson"
+	"time"
+)
+
+// A running org without the database, the connections have no websocket
+// so their pushes stay in the queues
+func newTestActiveOrg() *ws.ActiveOrg {
+	orgId := bson.NewObjectId()
+	activeOrg := &ws.ActiveOrg{
+		OrgId:        orgId.Hex(),
+		Organization: &organizations.Organization{Id: orgId},
+		OnlineUsers:  make(map[bson.ObjectId]*ws.OnlineUser),
+		Broadcast:    make(chan ws.GenericPushingMessage),
+		CloseSign:    make(chan bool, 1),
+		Done:         make(chan bool),
+		Config:       config,
+		NewMessages:  ws.NewMemoryNewMessageStore(time.Hour),
+	}
+
+	mu.Lock()
+	activeOrgMap[activeOrg.OrgId] = activeOrg
+	mu.Unlock()
+	return activeOrg
+}
+
+func removeTestActiveOrg(activeOrg *ws.ActiveOrg) {
+	mu.Lock()
+	delete(activeOrgMap, activeOrg.OrgId)
+	mu.Unlock()
+}
+
+func newTestUser(activeOrg *ws.ActiveOrg) (onlineUser *ws.OnlineUser, conn *ws.Connection) {
+	id := bson.NewObjectId()
+	user := &users.User{Id: id, Email: id.Hex() + "@example.com"}
+	onlineUser, conn, _ = activeOrg.GetOrInitOnlineUser(user, nil, ws.NO_RESUME)
+	popPushes(conn) // Server.Synced
+	return
+}
+
+// The methods of the queued pushes, taking them out of the queue
+func popPushes(conn *ws.Connection) (methods []string) {
+	for conn.Queue.Len() > 0 {
+		msg, _ := conn.Queue.Pop()
+		if push, ok := msg.(ws.MethodPush); ok {
+			methods = append(methods, push.PushMethod())
+		}
+	}
+	return
+}
+
+// Only the allowed users can view the groups, entries and conversations
+type fakeTopicGuard struct {
+	allowed map[bson.ObjectId]bool
+}
+
+func (this *fakeTopicGuard) check(serv *WsService) error {
+	if this.allowed[serv.LoggedInUser.Id] {
+		return nil
+	}
+	return ErrTopicForbidden
+}
+
+func (this *fakeTopicGuard) CanViewGroup(serv *WsService, groupId string) error {
+	return this.check(serv)
+}
+
+func (this *fakeTopicGuard) CanViewEntry(serv *WsService, entryId string) error {
+	return this.check(serv)
+}
+
+func (this *fakeTopicGuard) CanViewConversation(serv *WsService, conversationId string) error {
+	return this.check(serv)
+}
+
+func useTopicGuard(guard TopicGuard) (restore func()) {
+	old := topicGuard
+	topicGuard = guard
+	return func() { topicGuard = old }
+}
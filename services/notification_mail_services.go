@@ -0,0 +1,155 @@
+package services
+
+import (
+	"bytes"
+	"github.com/kobeld/qortex-realtime/mailers"
+	"github.com/theplant/qortex/notifications"
+	"github.com/theplant/qortex/users"
+	"github.com/theplant/qortex/utils"
+	"github.com/theplant/qortexapi"
+	"log"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// What the mail templates are rendered with
+type NotificationMailData struct {
+	ToUser *notifications.ToUser
+	Sender *users.User
+	Entry  *qortexapi.Entry
+}
+
+var mailSubjects = map[int]*template.Template{
+	notifications.VT_NEW_COMMENT:        mailTemplate("{{.Sender.Email}} commented on {{.Entry.Title}}"),
+	notifications.VT_NEW_INNER_MESSAGE:  mailTemplate("New message from {{.Sender.Email}}"),
+	notifications.VT_POST_NEED_ACK:      mailTemplate("{{.Sender.Email}} asks you to acknowledge {{.Entry.Title}}"),
+	notifications.VT_COMMENT_NEED_ACK:   mailTemplate("{{.Sender.Email}} asks you to acknowledge a comment on {{.Entry.Title}}"),
+	notifications.VT_NEW_SHARED_REQUEST: mailTemplate("{{.Sender.Email}} wants to share a group with you"),
+}
+
+var (
+	defaultMailSubject = mailTemplate("{{.Sender.Email}} posted {{.Entry.Title}}")
+	mailBody           = mailTemplate(`Hi {{.ToUser.Name}},
+
+{{.Sender.Email}} has something new for you while you were away:
+
+    {{.Entry.Title}}
+
+Sign in to Qortex to read it.
+`)
+)
+
+func mailTemplate(text string) *template.Template {
+	return template.Must(template.New("mail").Parse(text))
+}
+
+// Nil when config.Mailer is empty
+var mailer mailers.Mailer
+
+func InitMailer(m mailers.Mailer) {
+	mailer = m
+}
+
+var (
+	mailThrottleMu sync.Mutex
+	lastMailedAt   = make(map[string]time.Time)
+)
+
+// Only the offline users are mailed, and only once per notification even if they are
+// in the eventMap several times, like the members of Qortex Support.
+// emailToUserMap keeps who has been through here for the notification.
+func mailOfflineUser(emailToUserMap map[string]bool, currentUser *users.User, toUserId string,
+	event *notifications.Event, apiEntry *qortexapi.Entry, isOffline, needMail bool) {
+
+	_, exist := emailToUserMap[toUserId]
+	emailToUserMap[toUserId] = true
+
+	if !isOffline || exist || !needMail {
+		return
+	}
+	sendNotificationMail(currentUser, toUserId, event, apiEntry)
+}
+
+// Mail the offline user about the event, at most once per config.MailThrottle.
+// The mailer doesn't block, the smtp one sends in the background.
+func sendNotificationMail(currentUser *users.User, toUserId string, event *notifications.Event, apiEntry *qortexapi.Entry) {
+	if mailer == nil || event.ToUser == nil || event.ToUser.Email == "" {
+		return
+	}
+
+	data := &NotificationMailData{ToUser: event.ToUser, Sender: currentUser, Entry: apiEntry}
+	mail, err := renderNotificationMail(event.VType, data)
+	if err != nil {
+		utils.PrintStackAndError(err)
+		return
+	}
+
+	// Only a mail that can go counts, the quota is given back when it isn't queued
+	key := toUserId + "-" + event.ToUser.OriginalOrgId
+	if !takeMailQuota(key) {
+		return
+	}
+
+	if err = mailer.Send(mail); err != nil {
+		releaseMailQuota(key)
+		utils.PrintStackAndError(err)
+	}
+}
+
+// Send the queued mails on shutdown, the mailers sending right away have nothing to do
+func StopMailer(deadline time.Time) {
+	stoppable, ok := mailer.(mailers.StoppableMailer)
+	if !ok {
+		return
+	}
+	if err := stoppable.Stop(deadline); err != nil {
+		log.Println(err)
+	}
+}
+
+func renderNotificationMail(vType int, data *NotificationMailData) (mail *mailers.Mail, err error) {
+	subjectTemplate, ok := mailSubjects[vType]
+	if !ok {
+		subjectTemplate = defaultMailSubject
+	}
+
+	var subject, body bytes.Buffer
+	if err = subjectTemplate.Execute(&subject, data); err != nil {
+		return
+	}
+	if err = mailBody.Execute(&body, data); err != nil {
+		return
+	}
+
+	// The titles are user input, the subject stays on one line
+	oneLine := strings.Join(strings.Fields(subject.String()), " ")
+	mail = &mailers.Mail{To: data.ToUser.Email, Subject: oneLine, Body: body.String()}
+	return
+}
+
+func takeMailQuota(key string) bool {
+	mailThrottleMu.Lock()
+	defer mailThrottleMu.Unlock()
+
+	now := time.Now()
+	if last, ok := lastMailedAt[key]; ok && now.Sub(last) < config.MailThrottle.Duration {
+		return false
+	}
+
+	// Forget the ones out of the window, so the map doesn't keep growing
+	for k, last := range lastMailedAt {
+		if now.Sub(last) >= config.MailThrottle.Duration {
+			delete(lastMailedAt, k)
+		}
+	}
+	lastMailedAt[key] = now
+	return true
+}
+
+func releaseMailQuota(key string) {
+	mailThrottleMu.Lock()
+	defer mailThrottleMu.Unlock()
+	delete(lastMailedAt, key)
+}
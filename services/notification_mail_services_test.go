@@ -0,0 +1,184 @@
+package services
+
+import (
+	"github.com/kobeld/qortex-realtime/mailers"
+	"github.com/theplant/qortex/notifications"
+	"github.com/theplant/qortex/users"
+	"github.com/theplant/qortexapi"
+	"labix.org/v2/mgo/bson"
+	"strings"
+	"testing"
+	"time"
+)
+
+func useMemoryMailer(throttle time.Duration) (memory *mailers.MemoryMailer, restore func()) {
+	oldMailer, oldThrottle := mailer, config.MailThrottle.Duration
+
+	memory = mailers.NewMemoryMailer()
+	mailer = memory
+	config.MailThrottle.Duration = throttle
+
+	mailThrottleMu.Lock()
+	lastMailedAt = make(map[string]time.Time)
+	mailThrottleMu.Unlock()
+
+	return memory, func() {
+		mailer, config.MailThrottle.Duration = oldMailer, oldThrottle
+	}
+}
+
+func newMailEvent(vType int) (toUserId string, event *notifications.Event) {
+	toUserId = bson.NewObjectId().Hex()
+	event = &notifications.Event{
+		VType: vType,
+		ToUser: &notifications.ToUser{
+			OriginalOrgId: bson.NewObjectId().Hex(),
+			Email:         "to@example.com",
+			Name:          "To",
+		},
+	}
+	return
+}
+
+var mailSender = &users.User{Id: bson.NewObjectId(), Email: "sender@example.com"}
+var mailEntry = &qortexapi.Entry{Title: "Weekly report"}
+
+func TestMailOfflineUserOnlyOncePerNotification(t *testing.T) {
+	memory, restore := useMemoryMailer(0)
+	defer restore()
+
+	toUserId, event := newMailEvent(notifications.VT_NEW_POST)
+	emailToUserMap := make(map[string]bool)
+
+	// The same member in the eventMap for two organizations
+	mailOfflineUser(emailToUserMap, mailSender, toUserId, event, mailEntry, true, true)
+	mailOfflineUser(emailToUserMap, mailSender, toUserId, event, mailEntry, true, true)
+
+	if n := len(memory.Mails()); n != 1 {
+		t.Fatalf("expected 1 mail, got %d", n)
+	}
+}
+
+func TestMailOfflineUserOnlyWhenOffline(t *testing.T) {
+	memory, restore := useMemoryMailer(0)
+	defer restore()
+
+	toUserId, event := newMailEvent(notifications.VT_NEW_POST)
+	mailOfflineUser(make(map[string]bool), mailSender, toUserId, event, mailEntry, false, true)
+	if n := len(memory.Mails()); n != 0 {
+		t.Fatalf("expected no mail to an online user, got %d", n)
+	}
+
+	mailOfflineUser(make(map[string]bool), mailSender, toUserId, event, mailEntry, true, false)
+	if n := len(memory.Mails()); n != 0 {
+		t.Fatalf("expected no mail when the event needs none, got %d", n)
+	}
+
+	mailOfflineUser(make(map[string]bool), mailSender, toUserId, event, mailEntry, true, true)
+	if n := len(memory.Mails()); n != 1 {
+		t.Fatalf("expected 1 mail to the offline user, got %d", n)
+	}
+}
+
+func TestMailThrottle(t *testing.T) {
+	memory, restore := useMemoryMailer(50 * time.Millisecond)
+	defer restore()
+
+	toUserId, event := newMailEvent(notifications.VT_NEW_POST)
+	sendNotificationMail(mailSender, toUserId, event, mailEntry)
+	sendNotificationMail(mailSender, toUserId, event, mailEntry)
+	if n := len(memory.Mails()); n != 1 {
+		t.Fatalf("expected 1 mail within the window, got %d", n)
+	}
+
+	// Another user isn't throttled by the first one
+	otherUserId, otherEvent := newMailEvent(notifications.VT_NEW_POST)
+	sendNotificationMail(mailSender, otherUserId, otherEvent, mailEntry)
+	if n := len(memory.Mails()); n != 2 {
+		t.Fatalf("expected 2 mails, got %d", n)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	sendNotificationMail(mailSender, toUserId, event, mailEntry)
+	if n := len(memory.Mails()); n != 3 {
+		t.Fatalf("expected a mail after the window, got %d mails", n)
+	}
+}
+
+type fullMailer struct {
+	sent *mailers.MemoryMailer
+	full bool
+}
+
+func (this *fullMailer) Send(mail *mailers.Mail) error {
+	if this.full {
+		return mailers.ErrQueueFull
+	}
+	return this.sent.Send(mail)
+}
+
+func TestMailQuotaOnlyTakenWhenQueued(t *testing.T) {
+	_, restore := useMemoryMailer(time.Hour)
+	defer restore()
+
+	full := &fullMailer{sent: mailers.NewMemoryMailer(), full: true}
+	mailer = full
+
+	toUserId, event := newMailEvent(notifications.VT_NEW_POST)
+	sendNotificationMail(mailSender, toUserId, event, mailEntry)
+
+	// The dropped mail doesn't hold the window, the next one goes
+	full.full = false
+	sendNotificationMail(mailSender, toUserId, event, mailEntry)
+	if n := len(full.sent.Mails()); n != 1 {
+		t.Fatalf("expected the mail after a full queue to go, got %d mails", n)
+	}
+
+	sendNotificationMail(mailSender, toUserId, event, mailEntry)
+	if n := len(full.sent.Mails()); n != 1 {
+		t.Fatalf("expected the queued mail to take the quota, got %d mails", n)
+	}
+}
+
+func TestRenderNotificationMailPerVType(t *testing.T) {
+	cases := []struct {
+		vType   int
+		subject string
+	}{
+		{notifications.VT_NEW_COMMENT, "sender@example.com commented on Weekly report"},
+		{notifications.VT_NEW_INNER_MESSAGE, "New message from sender@example.com"},
+		{notifications.VT_POST_NEED_ACK, "sender@example.com asks you to acknowledge Weekly report"},
+		{notifications.VT_COMMENT_NEED_ACK, "sender@example.com asks you to acknowledge a comment on Weekly report"},
+		{notifications.VT_NEW_SHARED_REQUEST, "sender@example.com wants to share a group with you"},
+		{notifications.VT_NEW_POST, "sender@example.com posted Weekly report"},
+	}
+
+	for _, c := range cases {
+		_, event := newMailEvent(c.vType)
+		data := &NotificationMailData{ToUser: event.ToUser, Sender: mailSender, Entry: mailEntry}
+		mail, err := renderNotificationMail(c.vType, data)
+		if err != nil {
+			t.Fatalf("vType %d: %s", c.vType, err)
+		}
+		if mail.Subject != c.subject {
+			t.Errorf("vType %d: expected subject %q, got %q", c.vType, c.subject, mail.Subject)
+		}
+		if mail.To != "to@example.com" || !strings.Contains(mail.Body, "Hi To,") {
+			t.Errorf("vType %d: unexpected mail %+v", c.vType, mail)
+		}
+	}
+}
+
+func TestRenderNotificationMailKeepsSubjectOnOneLine(t *testing.T) {
+	_, event := newMailEvent(notifications.VT_NEW_POST)
+	entry := &qortexapi.Entry{Title: "Hi\r\nBcc: someone@example.com"}
+	data := &NotificationMailData{ToUser: event.ToUser, Sender: mailSender, Entry: entry}
+
+	mail, err := renderNotificationMail(notifications.VT_NEW_POST, data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.ContainsAny(mail.Subject, "\r\n") {
+		t.Fatalf("expected the subject on one line, got %q", mail.Subject)
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"github.com/theplant/qortex/notifications"
 	"github.com/theplant/qortex/nsqproducers"
 	"github.com/theplant/qortex/organizations"
-	"github.com/theplant/qortex/services"
 	"github.com/theplant/qortex/users"
 	"github.com/theplant/qortex/utils"
 	"labix.org/v2/mgo/bson"
@@ -15,12 +14,15 @@ import (
 
 func SendEntryNotification(entryTopicData *nsqproducers.EntryTopicData) (err error) {
 
-	serv, err := MakeWsService(entryTopicData.OrgId, entryTopicData.UserId)
+	serv, err := MakeSenderWsService(entryTopicData.OrgId, entryTopicData.UserId)
 	if err != nil {
 		utils.PrintStackAndError(err)
 		return
 	}
 
+	// The viewers first, the entry may be gone already when deleted
+	pushEntryToViewers(entryTopicData)
+
 	apiEntry := entryTopicData.ApiEntry
 	currentOrg := serv.CurrentOrg
 	currentUser := serv.LoggedInUser
@@ -45,7 +47,6 @@ func SendEntryNotification(entryTopicData *nsqproducers.EntryTopicData) (err err
 		entity = notifications.NewLikeEntity(currentOrg, currentUser, entry, hasLiked)
 	}
 
-	// currentTime := time.Now()
 	causedEntry := entity.CausedEntry()
 	causedEntries := entity.CausedEntries()
 	eventMap := entity.Events(db)
@@ -97,20 +98,20 @@ func SendEntryNotification(entryTopicData *nsqproducers.EntryTopicData) (err err
 		}
 
 		onlineUser := pickOnlineUser(toUserObjectId, onlineUsers)
-		if onlineUser == nil {
+		onlineElsewhere := isOnlineInCluster(toUserObjectId)
 
-			// Don't send mail multi times to the same member when posting a Qortex Support
-			_, exist := emailToUserMap[toUserId]
-			if !exist && event.NeedToSendNotificationMail() {
-				// Send Mail if user offline, only work in Dev and Production
-				// serv.SendNotificationMail(event, apiEntry, currentTime, orgMap)
-			}
+		isOffline := onlineUser == nil && !onlineElsewhere
+		mailOfflineUser(emailToUserMap, currentUser, toUserId, event, apiEntry,
+			isOffline, event.NeedToSendNotificationMail())
 
-		} else if entity.NeetToSendRealtimeNotification(onlineUser.User) {
+		if onlineUser != nil && entity.NeetToSendRealtimeNotification(onlineUser.User) {
 			makeAndPushEventReply(currentUser, event, entity, onlineUser)
 		}
 
-		emailToUserMap[toUserId] = true
+		// The user is (also) connected to other nodes of the cluster
+		if onlineElsewhere {
+			pushEventToRemoteUser(currentUser, toUserObjectId, event, entity, orgMap)
+		}
 	}
 
 	return
@@ -119,7 +120,42 @@ func SendEntryNotification(entryTopicData *nsqproducers.EntryTopicData) (err err
 func makeAndPushEventReply(currentUser *users.User, event *notifications.Event,
 	entity notifications.Entity, onlineUser *ws.OnlineUser) {
 
-	// entry := entity.CausedEntry()
+	groupId, newMessage, ok := eventCounterPush(currentUser, onlineUser.User.Id, event, entity)
+	if ok {
+		queueCounterPush(onlineUser, groupId, newMessage)
+	}
+	return
+}
+
+// The user is connected to another node of the cluster, forward the push there
+func pushEventToRemoteUser(currentUser *users.User, toUserId bson.ObjectId, event *notifications.Event,
+	entity notifications.Entity, orgMap map[string]*organizations.Organization) {
+
+	org := orgMap[event.ToUser.OriginalOrgId]
+	if org == nil {
+		return
+	}
+
+	toUser, err := users.FindById(org.Database, toUserId)
+	if err != nil {
+		utils.PrintStackAndError(err)
+		return
+	}
+
+	if !entity.NeetToSendRealtimeNotification(toUser) {
+		return
+	}
+
+	groupId, newMessage, ok := eventCounterPush(currentUser, toUserId, event, entity)
+	if ok {
+		forwardCounterPush(toUserId, groupId, newMessage)
+	}
+	return
+}
+
+// Decide the counter push of the event. A newMessage without EntryId means a plain Counter.Refresh.
+func eventCounterPush(currentUser *users.User, toUserId bson.ObjectId, event *notifications.Event,
+	entity notifications.Entity) (groupId string, newMessage ws.NewMessage, ok bool) {
 
 	switch event.VType {
 	case notifications.VT_DEFAULT, notifications.VT_NEW_POST, notifications.VT_NEW_TODO,
@@ -128,28 +164,14 @@ func makeAndPushEventReply(currentUser *users.User, event *notifications.Event,
 		notifications.VT_FORWARDED_SHARED_REQUEST, notifications.VT_NEW_QORTEX_BROADCAST,
 		notifications.VT_NEW_QORTEX_FEEDBACK, notifications.VT_NEW_INNER_MESSAGE:
 
-		reply := CountNotification{
-			Method:  "Counter.Refresh",
-			GroupId: entity.CausedEntry().GroupId.Hex(),
-			MyCount: services.UserCountData(onlineUser.AllDBs(), onlineUser.User),
-		}
-
-		if event.IsFollowed && currentUser.Id != onlineUser.User.Id {
-			reply.Method = "Counter.NewArrived"
-			reply.NewEntry = true
-			reply.EntryId = entity.NewEntryId().Hex()
-			reply.NewMessageNumber = onlineUser.AddNewMessageId(reply.EntryId)
+		causedEntry := entity.CausedEntry()
+		if event.IsFollowed && currentUser.Id != toUserId {
+			newMessage = newArrival(causedEntry, entity.NewEntryId().Hex())
 		}
-		onlineUser.SendReply(reply)
+		return causedEntry.GroupId.Hex(), newMessage, true
 
 	case notifications.VT_LIKE, notifications.VT_REMOVE_LIKE:
-
-		reply := CountNotification{
-			Method:  "Counter.Refresh",
-			GroupId: entity.CausedEntry().GroupId.Hex(),
-			MyCount: services.UserCountData(onlineUser.AllDBs(), onlineUser.User),
-		}
-		onlineUser.SendReply(reply)
+		return entity.CausedEntry().GroupId.Hex(), newMessage, true
 	}
 	return
 }
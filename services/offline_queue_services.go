@@ -0,0 +1,136 @@
+package services
+
+import (
+	"encoding/json"
+	"github.com/kobeld/qortex-realtime/models/ws"
+	"github.com/kobeld/qortex-realtime/producers"
+	"github.com/theplant/qortex/utils"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"sync"
+	"time"
+)
+
+// The statuses of the offline queue messages
+const (
+	OFFLINE_STATUS_OFFLINE = "offline"
+	OFFLINE_STATUS_ONLINE  = "online"
+)
+
+// Published to config.OfflineTopic. The digest mail is queued on "offline",
+// and should be cancelled on a later "online" of the same user and org.
+// The "online" may be missing, e.g. the node restarted in between, so before
+// sending the digest the consumer should also check the user's onlineat in
+// LAST_ONLINE_COLLECTION of the org is not after Time.
+type OfflineUserMessage struct {
+	Status string
+	UserId string
+	OrgId  string
+	Time   time.Time
+}
+
+// Nil when config.OfflineTopic is empty
+var offlineProducer producers.Producer
+
+// The users coming online, by _id, the user id, in the org database
+const LAST_ONLINE_COLLECTION = "realtime_last_online"
+
+// The users put into the queue and not back yet, by "orgId/userId", with the time
+// they were put. Every node keeps them (see handleClusterMessage), the user may
+// come back on any of them. They are forgotten after config.OfflineQueueTTL.
+var (
+	offlineUsersMu sync.Mutex
+	offlineUsers   = make(map[string]time.Time)
+)
+
+func InitOfflineQueue(producer producers.Producer) {
+	offlineProducer = producer
+}
+
+func StopOfflineQueue() {
+	if offlineProducer != nil {
+		offlineProducer.Stop()
+	}
+}
+
+// The user is gone after the grace period, and not online on the other nodes.
+// Not while shutting down, the users are only moving to another node.
+func PutOfflineUserIntoQueue(onlineUser *ws.OnlineUser, offlineAt time.Time) {
+	if IsShuttingDown() {
+		return
+	}
+
+	queueOfflineUser(onlineUser.InActivedOrg.OrgId, onlineUser.User.Id.Hex(), offlineAt)
+}
+
+// Also for the users of a node gone without telling
+func queueOfflineUser(orgIdHex, userIdHex string, offlineAt time.Time) {
+	markOfflineUser(orgIdHex, userIdHex, true)
+	publishOfflineUser(orgIdHex, userIdHex, OFFLINE_STATUS_OFFLINE, offlineAt)
+}
+
+// The user is back, the digest queued for it isn't needed any more.
+// Nothing to cancel if it wasn't put into the queue, or this node forgot it,
+// the consumer still finds the online time.
+func CancelOfflineUser(onlineUser *ws.OnlineUser) {
+	if offlineProducer != nil {
+		recordOnlineTime(onlineUser, time.Now())
+	}
+	if !markOfflineUser(onlineUser.InActivedOrg.OrgId, onlineUser.User.Id.Hex(), false) {
+		return
+	}
+	publishOfflineUser(onlineUser.InActivedOrg.OrgId, onlineUser.User.Id.Hex(), OFFLINE_STATUS_ONLINE, time.Now())
+}
+
+// Returns whether the user was marked offline before
+func markOfflineUser(orgIdHex, userIdHex string, offline bool) (wasOffline bool) {
+	offlineUsersMu.Lock()
+	defer offlineUsersMu.Unlock()
+
+	now := time.Now()
+	for key, markedAt := range offlineUsers {
+		if now.Sub(markedAt) > config.OfflineQueueTTL.Duration {
+			delete(offlineUsers, key)
+		}
+	}
+
+	key := orgIdHex + "/" + userIdHex
+	_, wasOffline = offlineUsers[key]
+	if offline {
+		offlineUsers[key] = now
+	} else {
+		delete(offlineUsers, key)
+	}
+	return
+}
+
+func recordOnlineTime(onlineUser *ws.OnlineUser, at time.Time) {
+	db := onlineUser.InActivedOrg.Organization.Database
+	db.CollectionDo(LAST_ONLINE_COLLECTION, func(c *mgo.Collection) {
+		_, err := c.Upsert(bson.M{"_id": onlineUser.User.Id}, bson.M{"$set": bson.M{"onlineat": at}})
+		if err != nil {
+			utils.PrintStackAndError(err)
+		}
+	})
+}
+
+func publishOfflineUser(orgIdHex, userIdHex, status string, at time.Time) {
+	if offlineProducer == nil {
+		return
+	}
+
+	body, err := json.Marshal(OfflineUserMessage{
+		Status: status,
+		UserId: userIdHex,
+		OrgId:  orgIdHex,
+		Time:   at,
+	})
+	if err != nil {
+		utils.PrintStackAndError(err)
+		return
+	}
+
+	if err = offlineProducer.Publish(config.OfflineTopic, body); err != nil {
+		utils.PrintStackAndError(err)
+	}
+}
@@ -0,0 +1,133 @@
+package services
+
+import (
+	"encoding/json"
+	"github.com/kobeld/qortex-realtime/models/ws"
+	"github.com/kobeld/qortex-realtime/producers"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func useFakeProducer() (producer *producers.FakeProducer, restore func()) {
+	oldProducer, oldTopic := offlineProducer, config.OfflineTopic
+
+	producer = producers.NewFakeProducer()
+	offlineProducer = producer
+	config.OfflineTopic = "offline_users"
+
+	return producer, func() {
+		offlineProducer, config.OfflineTopic = oldProducer, oldTopic
+	}
+}
+
+// An org with the presence hooks, the users are cleaned up after the grace period
+func newOfflineTestActiveOrg(grace time.Duration) *ws.ActiveOrg {
+	activeOrg := newTestActiveOrg()
+	cfg := *config
+	cfg.OnlineUserCloseDuration.Duration = grace
+	activeOrg.Config = &cfg
+	activeOrg.OnUserOnline = userCameOnline
+	activeOrg.OnUserOffline = userWentOffline
+	return activeOrg
+}
+
+func publishedStatuses(t *testing.T, producer *producers.FakeProducer) (statuses []string) {
+	for _, msg := range producer.Messages() {
+		if msg.Topic != config.OfflineTopic {
+			t.Fatalf("expected topic %s, got %s", config.OfflineTopic, msg.Topic)
+		}
+
+		offlineUser := new(OfflineUserMessage)
+		if err := json.Unmarshal(msg.Body, offlineUser); err != nil {
+			t.Fatal(err)
+		}
+		statuses = append(statuses, offlineUser.Status)
+	}
+	return
+}
+
+func TestOfflinePublishedAfterTheGracePeriod(t *testing.T) {
+	producer, restore := useFakeProducer()
+	defer restore()
+
+	activeOrg := newOfflineTestActiveOrg(time.Millisecond)
+	defer removeTestActiveOrg(activeOrg)
+
+	onlineUser, conn := newTestUser(activeOrg)
+	if statuses := publishedStatuses(t, producer); len(statuses) != 0 {
+		t.Fatalf("expected nothing on the first connection, got %v", statuses)
+	}
+
+	onlineUser.KillConnection(conn)
+	waitUntil(t, "the offline message", func() bool {
+		return len(producer.Messages()) > 0
+	})
+
+	if statuses := publishedStatuses(t, producer); len(statuses) != 1 || statuses[0] != OFFLINE_STATUS_OFFLINE {
+		t.Fatalf("expected one offline, got %v", statuses)
+	}
+
+	// Back after being put into the queue
+	activeOrg.GetOrInitOnlineUser(onlineUser.User, nil, ws.NO_RESUME)
+	statuses := publishedStatuses(t, producer)
+	if len(statuses) != 2 || statuses[1] != OFFLINE_STATUS_ONLINE {
+		t.Fatalf("expected offline then online, got %v", statuses)
+	}
+}
+
+func TestNothingPublishedOnReconnectWithinTheGracePeriod(t *testing.T) {
+	producer, restore := useFakeProducer()
+	defer restore()
+
+	activeOrg := newOfflineTestActiveOrg(time.Hour)
+	defer removeTestActiveOrg(activeOrg)
+
+	onlineUser, conn := newTestUser(activeOrg)
+	onlineUser.KillConnection(conn)
+	_, newConn, _ := activeOrg.GetOrInitOnlineUser(onlineUser.User, nil, ws.NO_RESUME)
+	defer onlineUser.KillConnection(newConn)
+
+	if statuses := publishedStatuses(t, producer); len(statuses) != 0 {
+		t.Fatalf("expected nothing published, got %v", statuses)
+	}
+}
+
+func TestNothingPublishedWhileShuttingDown(t *testing.T) {
+	producer, restore := useFakeProducer()
+	defer restore()
+
+	activeOrg := newTestActiveOrg()
+	defer removeTestActiveOrg(activeOrg)
+	onlineUser, _ := newTestUser(activeOrg)
+
+	atomic.StoreInt32(&shuttingDown, 1)
+	defer atomic.StoreInt32(&shuttingDown, 0)
+
+	// A close timer firing during FinishShutdown
+	PutOfflineUserIntoQueue(onlineUser, time.Now())
+	if statuses := publishedStatuses(t, producer); len(statuses) != 0 {
+		t.Fatalf("expected nothing published, got %v", statuses)
+	}
+}
+
+func TestOfflineUsersForgottenAfterTheTTL(t *testing.T) {
+	oldTTL := config.OfflineQueueTTL.Duration
+	config.OfflineQueueTTL.Duration = 10 * time.Millisecond
+	defer func() { config.OfflineQueueTTL.Duration = oldTTL }()
+
+	markOfflineUser("org", "old", true)
+	time.Sleep(20 * time.Millisecond)
+	markOfflineUser("org", "new", true)
+
+	offlineUsersMu.Lock()
+	_, oldKept := offlineUsers["org/old"]
+	offlineUsersMu.Unlock()
+	if oldKept {
+		t.Fatal("expected the old user forgotten")
+	}
+
+	if !markOfflineUser("org", "new", false) {
+		t.Fatal("expected the new user still marked")
+	}
+}
@@ -1,11 +1,10 @@
 package services
 
-import (
-	"net/rpc"
-)
-
 func RegisterRpcs() {
-	rpc.Register(new(Counter))
-	// rpc.Register(new(Draft))
-	rpc.Register(new(Pulse))
+	rpcRouter.Register(new(Counter))
+	// rpcRouter.Register(new(Draft))
+	rpcRouter.Register(new(Pulse))
+	rpcRouter.Register(new(Presence))
+	rpcRouter.Register(new(Typing))
+	rpcRouter.Register(new(Topic))
 }
@@ -0,0 +1,314 @@
+package services
+
+import (
+	"errors"
+	"github.com/sunfmin/signature"
+	"github.com/theplant/qortex/configs"
+	"github.com/theplant/qortex/members"
+	"labix.org/v2/mgo/bson"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// The websocket sub-protocol carrying the bearer token: ["bearer", <token>]
+	BEARER_PROTOCOL = "bearer"
+)
+
+var (
+	ErrNoCredential   = errors.New("No credential in the request")
+	ErrInvalidBearer  = errors.New("The bearer sub-protocol needs a token")
+	ErrInvalidTicket  = errors.New("Invalid connect ticket or token")
+	ErrExpiredTicket  = errors.New("Connect ticket or token expired")
+	ErrRevokedTicket  = errors.New("Connect ticket or token revoked")
+	ErrTicketOrgWrong = errors.New("Connect ticket is not for this organization")
+)
+
+// Find out who is opening the websocket. It returns ErrNoCredential
+// when the request doesn't carry its kind of credential.
+type Authenticator interface {
+	Authenticate(req *http.Request) (member *members.Member, err error)
+}
+
+// The token authenticators check the signature of the token in the handshake,
+// without the lookups and without using up the ticket
+type tokenVerifier interface {
+	Verify(req *http.Request) error
+}
+
+// The authenticator of the credential the request carries. A request carrying
+// a token is only authenticated by the token, never falls back to the cookie,
+// so a cross-site page can't skip the origin check and ride on the cookie.
+func pickAuthenticator(req *http.Request) Authenticator {
+	if req.URL.Query().Get("ticket") != "" {
+		return new(TicketAuthenticator)
+	}
+	if _, ok := bearerToken(req); ok {
+		return new(BearerAuthenticator)
+	}
+	return new(CookieAuthenticator)
+}
+
+func authenticate(req *http.Request) (member *members.Member, err error) {
+	return pickAuthenticator(req).Authenticate(req)
+}
+
+// The signed "qortex" session cookie of the web app
+type CookieAuthenticator struct{}
+
+func (this *CookieAuthenticator) Authenticate(req *http.Request) (member *members.Member, err error) {
+	cookie, err := req.Cookie("qortex")
+	if err != nil || cookie.Value == "" {
+		err = ErrNoCredential
+		return
+	}
+	return getSessionMember(cookie.Value)
+}
+
+// The short-lived token of the native clients and cross-domain embeds, issued
+// by the main app like the tickets, but usable until it expires. It is the second
+// websocket sub-protocol after "bearer", or the access_token query if
+// config.AllowTokenQuery (the query ends up in the proxy and access logs).
+// The signed payload is {"id": memberId, "jti": tokenId, "iat": unix, "exp": unix}.
+type BearerAuthenticator struct{}
+
+func (this *BearerAuthenticator) Authenticate(req *http.Request) (member *members.Member, err error) {
+	token, ok := bearerToken(req)
+	if !ok {
+		err = ErrNoCredential
+		return
+	}
+
+	claims, err := verifyToken(token)
+	if err != nil {
+		return
+	}
+	return members.FindById(bson.ObjectIdHex(claims.memberId))
+}
+
+func (this *BearerAuthenticator) Verify(req *http.Request) (err error) {
+	token, _ := bearerToken(req)
+	_, err = verifyToken(token)
+	return
+}
+
+func verifyToken(token string) (claims *credentialClaims, err error) {
+	if token == "" {
+		err = ErrInvalidBearer
+		return
+	}
+
+	e, err := decodeTicket(token)
+	if err != nil {
+		return
+	}
+	if claims, err = parseClaims(e, config.TokenMaxAge.Duration); err != nil {
+		return
+	}
+	if Tickets.isRevoked(claims) {
+		err = ErrRevokedTicket
+	}
+	return
+}
+
+// The token of the bearer sub-protocol or the access_token query. ok tells
+// the client asked for the bearer auth, the token is empty if it is malformed.
+func bearerToken(req *http.Request) (token string, ok bool) {
+	protocols := splitProtocols(req.Header.Get("Sec-WebSocket-Protocol"))
+	if len(protocols) > 0 && protocols[0] == BEARER_PROTOCOL {
+		if len(protocols) == 2 {
+			token = protocols[1]
+		}
+		return token, true
+	}
+
+	if !config.AllowTokenQuery {
+		return
+	}
+	token = req.URL.Query().Get("access_token")
+	return token, token != ""
+}
+
+// Short-lived tickets issued by the main app, passed in the ticket query.
+// The signed payload is {"id": memberId, "org": orgId, "jti": ticketId, "iat": unix, "exp": unix}.
+// A ticket is used once, on whichever node the client lands (see UsedTicketStore).
+type TicketAuthenticator struct{}
+
+func (this *TicketAuthenticator) Authenticate(req *http.Request) (member *members.Member, err error) {
+	ticket := req.URL.Query().Get("ticket")
+	if ticket == "" {
+		err = ErrNoCredential
+		return
+	}
+
+	e, err := decodeTicket(ticket)
+	if err != nil {
+		return
+	}
+
+	memberId, err := useTicket(e, req.URL.Query().Get("o"))
+	if err != nil {
+		return
+	}
+	return members.FindById(bson.ObjectIdHex(memberId))
+}
+
+// Check the claims of the decoded ticket and use it up
+func useTicket(e map[string]interface{}, orgIdHex string) (memberId string, err error) {
+	claims, err := parseClaims(e, config.TicketMaxAge.Duration)
+	if err != nil {
+		return
+	}
+
+	if claims.orgId != "" && claims.orgId != orgIdHex {
+		err = ErrTicketOrgWrong
+		return
+	}
+
+	if Tickets.isRevoked(claims) {
+		err = ErrRevokedTicket
+		return
+	}
+
+	// A ticket can only be used once
+	first, err := Tickets.Used.Use(orgIdHex, claims.id, claims.expires)
+	if err != nil {
+		return
+	}
+	if !first {
+		err = ErrRevokedTicket
+		return
+	}
+	return claims.memberId, nil
+}
+
+func (this *TicketAuthenticator) Verify(req *http.Request) (err error) {
+	_, err = decodeTicket(req.URL.Query().Get("ticket"))
+	return
+}
+
+func decodeTicket(ticket string) (e map[string]interface{}, err error) {
+	err = signature.DecodeString(ticket, &e, ticketSecret())
+	return
+}
+
+func ticketSecret() string {
+	if config.TicketSecret != "" {
+		return config.TicketSecret
+	}
+	return configs.SESSION_SECRET
+}
+
+// What the tickets and the tokens say
+type credentialClaims struct {
+	memberId string
+	orgId    string
+	id       string
+	issuedAt time.Time
+	expires  time.Time
+}
+
+// They must expire within maxAge
+func parseClaims(e map[string]interface{}, maxAge time.Duration) (claims *credentialClaims, err error) {
+	memberId, _ := e["id"].(string)
+	orgId, _ := e["org"].(string)
+	id, _ := e["jti"].(string)
+	issuedAt, _ := e["iat"].(float64)
+	expiresAt, _ := e["exp"].(float64)
+	if !bson.IsObjectIdHex(memberId) || id == "" || expiresAt == 0 {
+		err = ErrInvalidTicket
+		return
+	}
+
+	now := time.Now()
+	expires := time.Unix(int64(expiresAt), 0)
+	if now.After(expires) || expires.Sub(now) > maxAge {
+		err = ErrExpiredTicket
+		return
+	}
+
+	claims = &credentialClaims{
+		memberId: memberId,
+		orgId:    orgId,
+		id:       id,
+		issuedAt: time.Unix(int64(issuedAt), 0),
+		expires:  expires,
+	}
+	return
+}
+
+// The revoked tickets and tokens, remembered until they expire anyway.
+// The revocations reach every node (TicketRevokedConsumer).
+// The used tickets are kept by Used, shared by the nodes in cluster mode.
+type TicketRegistry struct {
+	Used          UsedTicketStore
+	revoked       map[string]time.Time
+	revokedBefore map[string]time.Time
+	lock          sync.Mutex
+}
+
+var Tickets = &TicketRegistry{
+	Used:          NewMemoryUsedTicketStore(),
+	revoked:       make(map[string]time.Time),
+	revokedBefore: make(map[string]time.Time),
+}
+
+// Revoke a single ticket or token
+func (this *TicketRegistry) Revoke(id string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.revoked[id] = time.Now().Add(this.maxAge())
+}
+
+// Revoke all the tickets and tokens of the member issued until now, e.g. on logout
+func (this *TicketRegistry) RevokeMember(memberId string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.revokedBefore[memberId] = time.Now()
+}
+
+func (this *TicketRegistry) isRevoked(claims *credentialClaims) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	this.cleanup()
+
+	if _, revoked := this.revoked[claims.id]; revoked {
+		return true
+	}
+	before, ok := this.revokedBefore[claims.memberId]
+	return ok && !claims.issuedAt.After(before)
+}
+
+// Nothing revoked lives longer than this
+func (this *TicketRegistry) maxAge() time.Duration {
+	if config.TokenMaxAge.Duration > config.TicketMaxAge.Duration {
+		return config.TokenMaxAge.Duration
+	}
+	return config.TicketMaxAge.Duration
+}
+
+func (this *TicketRegistry) cleanup() {
+	now := time.Now()
+	for id, expires := range this.revoked {
+		if now.After(expires) {
+			delete(this.revoked, id)
+		}
+	}
+	for memberId, before := range this.revokedBefore {
+		if now.Sub(before) > this.maxAge() {
+			delete(this.revokedBefore, memberId)
+		}
+	}
+}
+
+func splitProtocols(header string) (protocols []string) {
+	for _, p := range strings.Split(header, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			protocols = append(protocols, p)
+		}
+	}
+	return
+}
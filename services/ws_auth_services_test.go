@@ -0,0 +1,180 @@
+package services
+
+import (
+	"github.com/kobeld/qortex-realtime/configs"
+	"labix.org/v2/mgo/bson"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func newTicketClaims() map[string]interface{} {
+	now := time.Now()
+	return map[string]interface{}{
+		"id":  bson.NewObjectId().Hex(),
+		"jti": bson.NewObjectId().Hex(),
+		"iat": float64(now.Unix()),
+		"exp": float64(now.Add(time.Minute).Unix()),
+	}
+}
+
+func TestTicketOnlyUsedOnce(t *testing.T) {
+	claims := newTicketClaims()
+	if _, err := useTicket(claims, ""); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := useTicket(claims, ""); err != ErrRevokedTicket {
+		t.Fatalf("expected ErrRevokedTicket the second time, got %v", err)
+	}
+}
+
+// Whichever node gets the ticket, it is only used once
+func TestTicketUsedOnceAcrossNodes(t *testing.T) {
+	oldTickets := Tickets
+	defer func() { Tickets = oldTickets }()
+
+	shared := NewMemoryUsedTicketStore()
+	newNode := func() *TicketRegistry {
+		return &TicketRegistry{
+			Used:          shared,
+			revoked:       make(map[string]time.Time),
+			revokedBefore: make(map[string]time.Time),
+		}
+	}
+
+	claims := newTicketClaims()
+	Tickets = newNode()
+	if _, err := useTicket(claims, ""); err != nil {
+		t.Fatal(err)
+	}
+
+	Tickets = newNode()
+	if _, err := useTicket(claims, ""); err != ErrRevokedTicket {
+		t.Fatalf("expected ErrRevokedTicket on the other node, got %v", err)
+	}
+}
+
+func TestUsedTicketsExpire(t *testing.T) {
+	store := NewMemoryUsedTicketStore()
+	if first, _ := store.Use("", "a", time.Now().Add(-time.Second)); !first {
+		t.Fatal("expected the first use")
+	}
+	if first, _ := store.Use("", "a", time.Now().Add(time.Minute)); !first {
+		t.Fatal("expected the expired ticket forgotten")
+	}
+	if first, _ := store.Use("", "a", time.Now().Add(time.Minute)); first {
+		t.Fatal("expected the ticket used")
+	}
+}
+
+func TestTokenClaims(t *testing.T) {
+	expired := newTicketClaims()
+	expired["exp"] = float64(time.Now().Add(-time.Minute).Unix())
+
+	tooLong := newTicketClaims()
+	tooLong["exp"] = float64(time.Now().Add(config.TokenMaxAge.Duration + time.Hour).Unix())
+
+	// Longer than a ticket, but within TokenMaxAge
+	long := newTicketClaims()
+	long["exp"] = float64(time.Now().Add(config.TokenMaxAge.Duration - time.Minute).Unix())
+
+	revoked := newTicketClaims()
+	Tickets.Revoke(revoked["jti"].(string))
+
+	loggedOut := newTicketClaims()
+	loggedOut["iat"] = float64(time.Now().Add(-time.Minute).Unix())
+	Tickets.RevokeMember(loggedOut["id"].(string))
+
+	cases := []struct {
+		name   string
+		claims map[string]interface{}
+		err    error
+	}{
+		{"ok", newTicketClaims(), nil},
+		{"long", long, nil},
+		{"expired", expired, ErrExpiredTicket},
+		{"too long", tooLong, ErrExpiredTicket},
+		{"revoked", revoked, ErrRevokedTicket},
+		{"logged out", loggedOut, ErrRevokedTicket},
+	}
+
+	for _, c := range cases {
+		claims, err := parseClaims(c.claims, config.TokenMaxAge.Duration)
+		if err == nil && Tickets.isRevoked(claims) {
+			err = ErrRevokedTicket
+		}
+		if err != c.err {
+			t.Errorf("%s: expected %v, got %v", c.name, c.err, err)
+		}
+	}
+}
+
+func TestTokenQueryOnlyWhenAllowed(t *testing.T) {
+	defer func() { config.AllowTokenQuery = false }()
+
+	req, _ := http.NewRequest("GET", "http://example.com/conn?access_token=abc", nil)
+	if _, ok := bearerToken(req); ok {
+		t.Fatal("expected the access_token query ignored")
+	}
+
+	config.AllowTokenQuery = true
+	if token, ok := bearerToken(req); !ok || token != "abc" {
+		t.Fatalf("expected the access_token query taken, got %q %v", token, ok)
+	}
+
+	req.Header.Set("Sec-WebSocket-Protocol", BEARER_PROTOCOL+", xyz")
+	if token, ok := bearerToken(req); !ok || token != "xyz" {
+		t.Fatalf("expected the sub-protocol first, got %q %v", token, ok)
+	}
+}
+
+func TestTicketStoreInClusterMode(t *testing.T) {
+	cfg := configs.Default()
+	cfg.Backplane, cfg.NodeId = configs.BACKPLANE_MEMORY, "a"
+	cfg.TicketStore = configs.STORE_MEMORY
+	if err := cfg.Validate(); err == nil {
+		t.Fatal("expected the memory ticket store refused in cluster mode")
+	}
+
+	cfg.TicketStore = configs.STORE_MONGO
+	if err := cfg.Validate(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTicketClaims(t *testing.T) {
+	orgIdHex := bson.NewObjectId().Hex()
+
+	expired := newTicketClaims()
+	expired["exp"] = float64(time.Now().Add(-time.Minute).Unix())
+
+	tooLong := newTicketClaims()
+	tooLong["exp"] = float64(time.Now().Add(config.TicketMaxAge.Duration + time.Hour).Unix())
+
+	otherOrg := newTicketClaims()
+	otherOrg["org"] = bson.NewObjectId().Hex()
+
+	sameOrg := newTicketClaims()
+	sameOrg["org"] = orgIdHex
+
+	noId := newTicketClaims()
+	delete(noId, "jti")
+
+	cases := []struct {
+		name   string
+		claims map[string]interface{}
+		err    error
+	}{
+		{"expired", expired, ErrExpiredTicket},
+		{"too long", tooLong, ErrExpiredTicket},
+		{"other org", otherOrg, ErrTicketOrgWrong},
+		{"same org", sameOrg, nil},
+		{"no ticket id", noId, ErrInvalidTicket},
+	}
+
+	for _, c := range cases {
+		if _, err := useTicket(c.claims, orgIdHex); err != c.err {
+			t.Errorf("%s: expected %v, got %v", c.name, c.err, err)
+		}
+	}
+}
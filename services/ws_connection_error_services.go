@@ -0,0 +1,62 @@
+package services
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"github.com/kobeld/qortex-realtime/jsonrpc2"
+	"github.com/theplant/qortex/utils"
+	"labix.org/v2/mgo"
+	"time"
+)
+
+const (
+	CONNECTION_ERROR = "Connection.Error"
+)
+
+// Machine-readable codes of the Connection.Error push
+const (
+	CONN_ERR_UNAUTHENTICATED  = "unauthenticated"
+	CONN_ERR_ORG_NOT_FOUND    = "org_not_found"
+	CONN_ERR_NOT_A_MEMBER     = "not_a_member"
+	CONN_ERR_ACCOUNT_DISABLED = "account_disabled"
+	CONN_ERR_SHARED_GUEST     = "shared_guest"
+	CONN_ERR_SERVER_BUSY      = "server_busy"
+)
+
+// The last message sent before the server closes a rejected websocket.
+// RetryAfter is in seconds, 0 means reconnecting won't help until the
+// user does something (e.g. logs in again).
+type ConnectionError struct {
+	Method     string
+	Code       string
+	Message    string
+	RetryAfter int
+}
+
+func (this ConnectionError) PushMethod() string {
+	return this.Method
+}
+
+func rejectConnection(conn *websocket.Conn, code, message string) {
+	reply := ConnectionError{
+		Method:  CONNECTION_ERROR,
+		Code:    code,
+		Message: message,
+	}
+	if code == CONN_ERR_SERVER_BUSY {
+		reply.RetryAfter = int(config.BusyRetryAfter.Seconds())
+	}
+
+	conn.SetWriteDeadline(time.Now().Add(config.WriteTimeout.Duration))
+	if err := websocket.JSON.Send(conn, jsonrpc2.NewNotification(CONNECTION_ERROR, reply)); err != nil {
+		utils.PrintStackAndError(err)
+	}
+	conn.Close()
+}
+
+// Anything else than "not found" is our failure, the client should retry later
+func notFoundOr(err error, code string) string {
+	if err == mgo.ErrNotFound {
+		return code
+	}
+	return CONN_ERR_SERVER_BUSY
+}
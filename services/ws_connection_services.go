@@ -2,15 +2,17 @@ package services
 
 import (
 	"code.google.com/p/go.net/websocket"
+	"github.com/kobeld/qortex-realtime/models/ws"
 	"github.com/sunfmin/signature"
 	"github.com/theplant/qortex/configs"
 	"github.com/theplant/qortex/members"
-	"github.com/theplant/qortex/users"
 	"github.com/theplant/qortex/utils"
+	"labix.org/v2/mgo"
 	"labix.org/v2/mgo/bson"
 	"log"
-	"net/rpc/jsonrpc"
+	"net/http"
 	"runtime/debug"
+	"strconv"
 )
 
 // Entrance that builds and maintains the websocket connection for users
@@ -23,48 +25,110 @@ func BuildConnection(conn *websocket.Conn) {
 		}
 	}()
 
-	orgIdHex := conn.Request().URL.Query().Get("o")
-	if orgIdHex == "" {
+	// Don't take new connections while shutting down
+	if IsShuttingDown() {
+		rejectConnection(conn, CONN_ERR_SERVER_BUSY, "Server is shutting down")
 		return
 	}
 
-	wsCookie := ""
-	for _, cc := range conn.Request().Cookies() {
-		if cc.Name == "qortex" {
-			wsCookie = cc.Value
-			break
-		}
-	}
-	if wsCookie == "" {
+	orgIdHex := conn.Request().URL.Query().Get("o")
+	if !bson.IsObjectIdHex(orgIdHex) {
+		rejectConnection(conn, CONN_ERR_ORG_NOT_FOUND, "Invalid organization id")
 		return
 	}
 
-	member, _ := getSessionMember(wsCookie)
+	member, err := authenticate(conn.Request())
 	if member == nil {
+		if err != nil && err != ErrNoCredential && err != mgo.ErrNotFound {
+			log.Printf("Websocket: authentication failed: %s\n", err)
+		}
+		rejectConnection(conn, CONN_ERR_UNAUTHENTICATED, "Not logged in")
 		return
 	}
 
-	activeOrg, err := MyActiveOrg(orgIdHex)
-	if err != nil {
-		utils.PrintStackAndError(err)
+	// Checked against the org document, nothing is activated for the ones rejected
+	user, err := authorizeOrgMember(bson.ObjectIdHex(orgIdHex), member)
+	switch err {
+	case nil:
+	case mgo.ErrNotFound:
+		rejectConnection(conn, CONN_ERR_ORG_NOT_FOUND, "Can't open the organization")
 		return
-	}
-
-	user, err := users.FindById(activeOrg.Organization.Database, member.Id)
-	if err != nil {
+	case ErrNotAMember:
+		rejectConnection(conn, CONN_ERR_NOT_A_MEMBER, "Not a member of the organization")
+		return
+	case ErrSharedGuest:
+		rejectConnection(conn, CONN_ERR_SHARED_GUEST, "Connect to your own organization for the shared groups")
+		return
+	case ErrAccountDisabled:
+		rejectConnection(conn, CONN_ERR_ACCOUNT_DISABLED, "The account is disabled")
+		return
+	default:
 		utils.PrintStackAndError(err)
+		rejectConnection(conn, CONN_ERR_SERVER_BUSY, "Can't check the membership")
 		return
 	}
 
-	onlineUser := activeOrg.GetOrInitOnlineUser(user, conn)
+	var onlineUser *ws.OnlineUser
+	var wsConn *ws.Connection
+
+	// The org may be closed by its last user leaving right after it is got, then it is activated again
+	for {
+		activeOrg, err := MyActiveOrg(orgIdHex)
+		if err != nil {
+			utils.PrintStackAndError(err)
+			rejectConnection(conn, notFoundOr(err, CONN_ERR_ORG_NOT_FOUND), "Can't open the organization")
+			return
+		}
+
+		onlineUser, wsConn, err = activeOrg.GetOrInitOnlineUser(user, conn, resumeSeq(conn.Request()))
+		if err != ws.ErrOrgClosed {
+			break
+		}
+	}
 	log.Printf("----> New websocket connection for: %s, %+v running totally",
-		user.Email, len(onlineUser.WsConns))
+		user.Email, onlineUser.ConnectionCount())
 
 	// Holding the connection
-	jsonrpc.ServeConn(conn)
+	serveRpc(wsMessageReader{conn}, wsConn)
 
 	// Cut current connection and clean up related resources
-	onlineUser.KillWebsocket(conn)
+	onlineUser.KillConnection(wsConn)
+}
+
+// Handshake of the /conn upgrades. The cookie clients must come from an
+// allowed origin, so other sites can't ride on the user's cookie. The token
+// clients carry their own credential (native apps don't even send an Origin),
+// they may use the "bearer" sub-protocol. Their origin isn't checked once the
+// token is verified, and they are never authenticated by the cookie.
+func Handshake(wsConfig *websocket.Config, req *http.Request) (err error) {
+	wsConfig.Origin, err = requestOrigin(req)
+	if err != nil {
+		return
+	}
+
+	if len(wsConfig.Protocol) > 0 && wsConfig.Protocol[0] == BEARER_PROTOCOL {
+		wsConfig.Protocol = []string{BEARER_PROTOCOL}
+	}
+
+	if verifier, ok := pickAuthenticator(req).(tokenVerifier); ok {
+		return verifier.Verify(req)
+	}
+	return checkOrigin(wsConfig.Origin, req)
+}
+
+// The "resume" param: the seq of the last push the client got before reconnecting.
+// An invalid one gets a resync.
+func resumeSeq(req *http.Request) int64 {
+	v := req.URL.Query().Get("resume")
+	if v == "" {
+		return ws.NO_RESUME
+	}
+
+	seq, err := strconv.ParseUint(v, 10, 63)
+	if err != nil {
+		return 0
+	}
+	return int64(seq)
 }
 
 func getSessionMember(session string) (member *members.Member, err error) {
@@ -1,6 +1,8 @@
 package services
 
 import (
+	"github.com/kobeld/qortex-realtime/models/ws"
+	"github.com/theplant/qortex/entries"
 	"github.com/theplant/qortex/utils"
 	"github.com/theplant/qortexapi"
 )
@@ -10,37 +12,54 @@ const (
 	COUNTER_READ_MESSAGE      = "Counter.ReadMyMessage"
 	COUNTER_READ_NOTIFICATION = "Counter.ReadNotificationItem"
 	COUNTER_REFRESH           = "Counter.Refresh"
+	COUNTER_NEW_ARRIVED       = "Counter.NewArrived"
+	COUNTER_NEW_ARRIVALS      = "Counter.NewArrivals"
 )
 
 // Counter related reply data that
-// Refresh, ReadEntry and ReadNotificaiton all using
+// Refresh, ReadEntry and ReadNotificaiton all using.
+// NewCounts is the number of new messages per group:<id>/conversation:<id>.
 type CountNotification struct {
 	Method           string
-	GroupId          string
+	GroupId          string // Empty if the coalesced events span several groups
 	NewEntry         bool
 	EntryId          string
+	EntryIds         []string
 	DelType          string
 	MyCount          *qortexapi.MyCount
 	NewMessageNumber int
+	NewCounts        map[string]int
+}
+
+func (this CountNotification) PushMethod() string {
+	return this.Method
+}
+
+// Only the latest Counter.Refresh matters when the push queue is full
+func (this CountNotification) CoalesceKey() string {
+	if this.Method == COUNTER_REFRESH {
+		return COUNTER_REFRESH
+	}
+	return ""
 }
 
 type Counter int
 
 type RefreshInput struct {
+	RpcInput
 	LoggedInUserId string
 	OrganizationId string
 }
 
-func (this *Counter) Refresh(input *RefreshInput, reply *CountNotification) (err error) {
+func (this *RefreshInput) setContext(ctx *RpcContext) error {
+	this.ctx = ctx
+	return bindIds(ctx, &this.LoggedInUserId, &this.OrganizationId)
+}
 
-	defer func() {
-		if x := recover(); x != nil {
-			utils.PrintfStackAndError("Error: %+v \n For:", x.(error), input)
-		}
-	}()
+func (this *Counter) Refresh(input *RefreshInput, reply *CountNotification) (err error) {
 
 	reply.Method = COUNTER_REFRESH
-	serv, err := MakeWsService(input.OrganizationId, input.LoggedInUserId)
+	serv, err := input.Context().WsService()
 	if err != nil {
 		utils.PrintStackAndError(err)
 		return
@@ -56,6 +75,7 @@ func (this *Counter) Refresh(input *RefreshInput, reply *CountNotification) (err
 
 // Read Entry struct and methods
 type ReadEntryInput struct {
+	RpcInput
 	EntryId        string
 	ReaderId       string
 	GroupId        string
@@ -63,6 +83,11 @@ type ReadEntryInput struct {
 	ConversationId string
 }
 
+func (this *ReadEntryInput) setContext(ctx *RpcContext) error {
+	this.ctx = ctx
+	return bindIds(ctx, &this.ReaderId, &this.OrganizationId)
+}
+
 func (this *ReadEntryInput) isValid() bool {
 	if this.EntryId == "" || this.ReaderId == "" || this.OrganizationId == "" {
 		return false
@@ -80,40 +105,58 @@ func (this *ReadEntryInput) isReadMyMessage() bool {
 
 func (this *Counter) ReadEntry(input *ReadEntryInput, reply *CountNotification) (err error) {
 
-	defer func() {
-		if x := recover(); x != nil {
-			utils.PrintfStackAndError("Error: %+v \n For:", x.(error), input)
-		}
-	}()
-
 	if !input.isValid() {
+		err = InvalidInput("EntryId is required")
 		return
 	}
 
 	var myCount *qortexapi.MyCount
-	serv, err := MakeWsService(input.OrganizationId, input.ReaderId)
+	ctx := input.Context()
+	serv, err := ctx.WsService()
 	if err != nil {
 		utils.PrintStackAndError(err)
 		return
 	}
 
-	var method string
+	var method, topic string
 	switch {
 	case input.isReadEntry():
-		method = COUNTER_READ_ENTRY
-		myCount, err = serv.ReadEntry(input.EntryId, input.GroupId)
+		method, topic = COUNTER_READ_ENTRY, entryTopic(input.EntryId)
 	case input.isReadMyMessage():
-		method = COUNTER_READ_MESSAGE
-		myCount, err = serv.ReadMyMessage(input.ConversationId)
+		method, topic = COUNTER_READ_MESSAGE, conversationTopic(input.ConversationId)
 	default:
+		err = InvalidInput("Either GroupId or ConversationId is required")
+		return
+	}
+
+	kind, id, ok := parseTopic(topic)
+	if !ok {
+		err = InvalidInput("Invalid EntryId or ConversationId")
 		return
 	}
+	if err = authorizeTopic(ctx, kind, id); err != nil {
+		return
+	}
+
+	// Once it is read in the database the rest follows, so the counts stay right
+	if err = ctx.CheckDeadline(); err != nil {
+		return
+	}
+	if method == COUNTER_READ_ENTRY {
+		myCount, err = serv.ReadEntry(input.EntryId, input.GroupId)
+	} else {
+		myCount, err = serv.ReadMyMessage(input.ConversationId)
+	}
 	if err != nil {
 		utils.PrintStackAndError(err)
 		return
 	}
 
+	// Reading it means viewing it, e.g. for the typing pushes
+	ctx.Conn.View(topic)
+
 	if serv.OnlineUser == nil {
+		err = ws.ErrUserNotOnline
 		return
 	}
 
@@ -122,7 +165,8 @@ func (this *Counter) ReadEntry(input *ReadEntryInput, reply *CountNotification)
 		EntryId:          input.EntryId,
 		GroupId:          input.GroupId,
 		MyCount:          myCount,
-		NewMessageNumber: serv.OnlineUser.ClearNewMessageId(),
+		NewMessageNumber: readNewArrival(serv.OnlineUser, input),
+		NewCounts:        serv.OnlineUser.NewMessageCounts(),
 	}
 	serv.OnlineUser.SendReply(newReply)
 
@@ -131,41 +175,126 @@ func (this *Counter) ReadEntry(input *ReadEntryInput, reply *CountNotification)
 
 // Read the red notificaiton and realtime push the result to client
 type ReadNotificationInput struct {
+	RpcInput
 	NotificationItemId string
 	ReaderId           string
 	GroupId            string
 	OrganizationId     string
 }
 
+func (this *ReadNotificationInput) setContext(ctx *RpcContext) error {
+	this.ctx = ctx
+	return bindIds(ctx, &this.ReaderId, &this.OrganizationId)
+}
+
 func (this *Counter) ReadNotificationItem(input *ReadNotificationInput, reply *CountNotification) (err error) {
 
-	defer func() {
-		if x := recover(); x != nil {
-			utils.PrintfStackAndError("Error: %+v \n For:", x.(error), input)
-		}
-	}()
+	if input.NotificationItemId == "" {
+		err = InvalidInput("NotificationItemId is required")
+		return
+	}
 
 	var myCount *qortexapi.MyCount
-	serv, err := MakeWsService(input.OrganizationId, input.ReaderId)
+	ctx := input.Context()
+	serv, err := ctx.WsService()
 	if err != nil {
 		utils.PrintStackAndError(err)
 		return
 	}
+	if err = ctx.CheckDeadline(); err != nil {
+		return
+	}
 	if myCount, err = serv.ReadNotificationItem(input.NotificationItemId, input.GroupId); err != nil {
 		utils.PrintStackAndError(err)
 		return
 	}
 
 	if serv.OnlineUser == nil {
+		err = ws.ErrUserNotOnline
 		return
 	}
 
 	newReply := CountNotification{
 		Method:           COUNTER_READ_NOTIFICATION,
 		MyCount:          myCount,
-		NewMessageNumber: len(serv.OnlineUser.NewMessageIds),
+		NewMessageNumber: serv.OnlineUser.NewMessageNumber(),
 	}
 	serv.OnlineUser.SendReply(newReply)
 
 	return
 }
+
+// Reading an entry takes it and its new comments out of the new ones,
+// reading the conversation takes all of its messages
+func readNewArrival(onlineUser *ws.OnlineUser, input *ReadEntryInput) int {
+	if input.isReadMyMessage() {
+		return onlineUser.ClearNewMessageId(conversationTopic(input.ConversationId))
+	}
+	return onlineUser.DeleteNewMessageRoot(input.EntryId)
+}
+
+// The new entry caused by the entry, e.g. a comment of it
+func newArrival(causedEntry *entries.Entry, newEntryId string) ws.NewMessage {
+	rootId := causedEntry.Id
+	if causedEntry.RootId.Valid() {
+		rootId = causedEntry.RootId
+	}
+	return ws.NewMessage{Scope: newArrivalScope(causedEntry), RootId: rootId.Hex(), EntryId: newEntryId}
+}
+
+// Where a new entry is counted, the same names as the topics
+func newArrivalScope(entry *entries.Entry) string {
+	if entry.ConversationId.Valid() {
+		return conversationTopic(entry.ConversationId.Hex())
+	}
+	return groupTopic(entry.GroupId.Hex())
+}
+
+// Scope is group:<id> or conversation:<id>, empty for all of them
+type NewArrivalsInput struct {
+	RpcInput
+	Scope string
+}
+
+func (this *NewArrivalsInput) isValid() bool {
+	if this.Scope == "" {
+		return true
+	}
+	kind, _, ok := parseTopic(this.Scope)
+	return ok && (kind == TOPIC_GROUP || kind == TOPIC_CONVERSATION)
+}
+
+// The numbers of the new messages per group and conversation, only the scope's if it is given
+func (this *Counter) NewArrivals(input *NewArrivalsInput, reply *CountNotification) (err error) {
+	if !input.isValid() {
+		err = InvalidInput("Scope should be like group:<id> or conversation:<id>")
+		return
+	}
+
+	onlineUser := input.Context().OnlineUser
+
+	reply.Method = COUNTER_NEW_ARRIVALS
+	reply.NewMessageNumber = onlineUser.NewMessageNumber()
+	reply.NewCounts = onlineUser.NewMessageCounts()
+	if input.Scope != "" {
+		reply.NewCounts = map[string]int{input.Scope: reply.NewCounts[input.Scope]}
+	}
+	return
+}
+
+// Clear the new messages of the scope, the other connections of the user get the new numbers
+func (this *Counter) ClearNewArrivals(input *NewArrivalsInput, reply *CountNotification) (err error) {
+	if !input.isValid() {
+		err = InvalidInput("Scope should be like group:<id> or conversation:<id>")
+		return
+	}
+
+	onlineUser := input.Context().OnlineUser
+	*reply = CountNotification{
+		Method:           COUNTER_NEW_ARRIVALS,
+		NewMessageNumber: onlineUser.ClearNewMessageId(input.Scope),
+		NewCounts:        onlineUser.NewMessageCounts(),
+	}
+	onlineUser.SendReply(*reply)
+	return
+}
@@ -0,0 +1,122 @@
+package services
+
+import (
+	"github.com/kobeld/qortex-realtime/models/ws"
+	"github.com/theplant/qortex/entries"
+	"labix.org/v2/mgo/bson"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestReadEntryReadsItsNewComments(t *testing.T) {
+	activeOrg := newTestActiveOrg()
+	defer removeTestActiveOrg(activeOrg)
+
+	onlineUser, _ := newTestUser(activeOrg)
+	groupId, postId, otherPostId := bson.NewObjectId(), bson.NewObjectId(), bson.NewObjectId()
+
+	post := &entries.Entry{Id: postId, GroupId: groupId}
+	comment := &entries.Entry{Id: bson.NewObjectId(), GroupId: groupId, RootId: postId}
+	otherPost := &entries.Entry{Id: otherPostId, GroupId: groupId}
+
+	onlineUser.AddNewMessageId(newArrival(post, bson.NewObjectId().Hex()))
+	onlineUser.AddNewMessageId(newArrival(comment, bson.NewObjectId().Hex()))
+	onlineUser.AddNewMessageId(newArrival(otherPost, otherPostId.Hex()))
+
+	input := &ReadEntryInput{EntryId: postId.Hex(), GroupId: groupId.Hex()}
+	if number := readNewArrival(onlineUser, input); number != 1 {
+		t.Fatalf("expected the other post left, got %d new messages", number)
+	}
+
+	// The store is cleared the same way
+	messages, _ := activeOrg.NewMessages.Load(activeOrg.OrgId, onlineUser.User.Id.Hex())
+	if len(messages) != 1 || messages[0].EntryId != otherPostId.Hex() {
+		t.Fatalf("expected the other post left in the store, got %v", messages)
+	}
+}
+
+func TestNewArrivalsScope(t *testing.T) {
+	activeOrg := newTestActiveOrg()
+	defer removeTestActiveOrg(activeOrg)
+
+	onlineUser, conn := newTestUser(activeOrg)
+	groupA, groupB := groupTopic(bson.NewObjectId().Hex()), groupTopic(bson.NewObjectId().Hex())
+	onlineUser.AddNewMessageId(ws.NewMessage{Scope: groupA, EntryId: "1"})
+	onlineUser.AddNewMessageId(ws.NewMessage{Scope: groupA, EntryId: "2"})
+	onlineUser.AddNewMessageId(ws.NewMessage{Scope: groupB, EntryId: "3"})
+
+	cases := []struct {
+		scope  string
+		counts map[string]int
+		valid  bool
+	}{
+		{"", map[string]int{groupA: 2, groupB: 1}, true},
+		{groupA, map[string]int{groupA: 2}, true},
+		{conversationTopic(bson.NewObjectId().Hex()), nil, true},
+		{"entry:" + bson.NewObjectId().Hex(), nil, false},
+		{"group:nope", nil, false},
+	}
+
+	counter := new(Counter)
+	for _, c := range cases {
+		input := &NewArrivalsInput{Scope: c.scope}
+		input.setContext(newRpcContext(conn, COUNTER_NEW_ARRIVALS))
+
+		reply := new(CountNotification)
+		err := counter.NewArrivals(input, reply)
+		if !c.valid {
+			if err == nil {
+				t.Errorf("scope %q: expected an error", c.scope)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("scope %q: %s", c.scope, err)
+		}
+
+		if c.counts == nil {
+			c.counts = map[string]int{c.scope: 0}
+		}
+		if !reflect.DeepEqual(reply.NewCounts, c.counts) {
+			t.Errorf("scope %q: expected %v, got %v", c.scope, c.counts, reply.NewCounts)
+		}
+		if reply.NewMessageNumber != 3 {
+			t.Errorf("scope %q: expected 3 in total, got %d", c.scope, reply.NewMessageNumber)
+		}
+	}
+}
+
+// The calls past their deadline have been answered with a timeout, they change nothing
+func TestExpiredCallsHaveNoSideEffects(t *testing.T) {
+	activeOrg := newTestActiveOrg()
+	defer removeTestActiveOrg(activeOrg)
+
+	onlineUser, conn := newTestUser(activeOrg)
+	defer useTopicGuard(&fakeTopicGuard{allowed: map[bson.ObjectId]bool{onlineUser.User.Id: true}})()
+
+	ctx := newRpcContext(conn, COUNTER_READ_ENTRY)
+	ctx.Deadline = time.Now().Add(-time.Second)
+
+	entryId := bson.NewObjectId().Hex()
+	readInput := &ReadEntryInput{EntryId: entryId, GroupId: bson.NewObjectId().Hex()}
+	if err := readInput.setContext(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := new(Counter).ReadEntry(readInput, new(CountNotification)); err != ErrRpcTimeout {
+		t.Fatalf("expected ErrRpcTimeout, got %v", err)
+	}
+
+	topicInput := &TopicInput{Topic: entryTopic(entryId)}
+	topicInput.setContext(ctx)
+	if err := new(Topic).Subscribe(topicInput, new(bool)); err != ErrRpcTimeout {
+		t.Fatalf("expected ErrRpcTimeout, got %v", err)
+	}
+
+	if conn.IsSubscribed(entryTopic(entryId)) {
+		t.Error("expected the expired calls not to view or subscribe the entry")
+	}
+	if methods := popPushes(conn); len(methods) != 0 {
+		t.Errorf("expected no push, got %v", methods)
+	}
+}
@@ -1,17 +1,28 @@
 package services
 
 import (
+	"github.com/kobeld/qortex-realtime/configs"
 	"github.com/kobeld/qortex-realtime/models/ws"
 	"github.com/sunfmin/mgodb"
 	"github.com/theplant/qortex/organizations"
 	"github.com/theplant/qortex/services"
+	"github.com/theplant/qortex/users"
 	"github.com/theplant/qortex/utils"
 	"labix.org/v2/mgo/bson"
+	"log"
 	"sync"
 )
 
 var mu sync.Mutex
 
+var config = configs.Default()
+
+// Init hands the loaded config to the services, should be called before serving
+func Init(cfg *configs.Config) {
+	config = cfg
+	Tickets.Used = newUsedTicketStore(cfg)
+}
+
 // The map key is OrganizationId
 var activeOrgMap = make(map[string]*ws.ActiveOrg)
 
@@ -33,14 +44,41 @@ func MyActiveOrg(orgIdHex string) (activeOrg *ws.ActiveOrg, err error) {
 	}
 
 	// Should init the org and put into map for further use
-	org, err := organizations.FindById(orgId)
+	org, allDBs, err := loadOrg(orgId)
+	if err != nil {
+		return
+	}
+
+	// Init the activeOrg and put it into the map
+	activeOrg = &ws.ActiveOrg{
+		OrgId:         orgIdHex,
+		Organization:  org,
+		OnlineUsers:   make(map[bson.ObjectId]*ws.OnlineUser),
+		Broadcast:     make(chan ws.GenericPushingMessage),
+		CloseSign:     make(chan bool, 1),
+		Done:          make(chan bool),
+		AllDBs:        allDBs,
+		Config:        config,
+		NewMessages:   newMessageStore(org),
+		OnUserOnline:  userCameOnline,
+		OnUserOffline: userWentOffline,
+	}
+
+	go runActiveOrg(activeOrg)
+	activeOrgMap[orgIdHex] = activeOrg
+
+	return
+}
+
+// The org with all the dbs for handling shared groups
+func loadOrg(orgId bson.ObjectId) (org *organizations.Organization, allDBs []*mgodb.Database, err error) {
+	org, err = organizations.FindById(orgId)
 	if err != nil {
 		utils.PrintStackAndError(err)
 		return
 	}
 
-	// Find and maintain all dbs for handling shared groups
-	allDBs := []*mgodb.Database{org.Database}
+	allDBs = []*mgodb.Database{org.Database}
 	embedOrgs, err := organizations.FindByIds(org.EmbededOrgIds)
 	if err != nil {
 		utils.PrintStackAndError(err)
@@ -50,42 +88,105 @@ func MyActiveOrg(orgIdHex string) (activeOrg *ws.ActiveOrg, err error) {
 	for _, embedOrg := range embedOrgs {
 		allDBs = append(allDBs, embedOrg.Database)
 	}
+	return
+}
 
-	// Init the activeOrg and put it into the map
-	activeOrg = &ws.ActiveOrg{
-		OrgId:        orgIdHex,
-		Organization: org,
-		OnlineUsers:  make(map[bson.ObjectId]*ws.OnlineUser),
-		Broadcast:    make(chan ws.GenericPushingMessage),
-		CloseSign:    make(chan bool),
-		AllDBs:       allDBs,
+// Shared by all the orgs when the ids are kept in memory
+var memoryNewMessages *ws.MemoryNewMessageStore
+
+// The orgs whose new message indexes are made (or being made) since the start
+var (
+	indexedOrgsMu sync.Mutex
+	indexedOrgs   = make(map[string]bool)
+)
+
+// With mu held. The indexes are made in the background, once per org.
+func newMessageStore(org *organizations.Organization) ws.NewMessageStore {
+	if config.NewMessageStore == configs.STORE_MEMORY {
+		if memoryNewMessages == nil {
+			memoryNewMessages = ws.NewMemoryNewMessageStore(config.NewMessageTTL.Duration)
+		}
+		return memoryNewMessages
 	}
 
-	go runActiveOrg(activeOrg)
-	activeOrgMap[orgIdHex] = activeOrg
+	store := ws.NewMongoNewMessageStore(org.Database, config.NewMessageTTL.Duration)
+	go ensureNewMessageIndexes(org.Id.Hex(), store)
+	return store
+}
 
+// Without the indexes the ids still work, the expired ones are skipped
+// when loaded, so it is only logged and tried again on the next start
+func ensureNewMessageIndexes(orgIdHex string, store *ws.MongoNewMessageStore) {
+	indexedOrgsMu.Lock()
+	if indexedOrgs[orgIdHex] {
+		indexedOrgsMu.Unlock()
+		return
+	}
+	indexedOrgs[orgIdHex] = true
+	indexedOrgsMu.Unlock()
+
+	if err := store.EnsureIndexes(); err != nil {
+		log.Printf("New messages of org %s: can't ensure the indexes: %s\n", orgIdHex, err)
+	}
+}
+
+// Snapshot of the running orgs
+func allActiveOrgs() (activeOrgs []*ws.ActiveOrg) {
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, activeOrg := range activeOrgMap {
+		activeOrgs = append(activeOrgs, activeOrg)
+	}
 	return
 }
 
+// The running org, without activating it
+func findLocalActiveOrg(orgIdHex string) *ws.ActiveOrg {
+	mu.Lock()
+	defer mu.Unlock()
+	return activeOrgMap[orgIdHex]
+}
+
 // The heart of ActiveOrg
 func runActiveOrg(activeOrg *ws.ActiveOrg) {
 	for {
 		select {
 		case b := <-activeOrg.Broadcast:
-			for _, ou := range activeOrg.OnlineUsers {
-				ou.Send <- b
+			for _, ou := range activeOrg.OnlineUserList() {
+				ou.SendReply(b)
 			}
-		case c := <-activeOrg.CloseSign:
-			if c == true {
-				delete(activeOrgMap, activeOrg.OrgId)
-				close(activeOrg.Broadcast)
-				close(activeOrg.CloseSign)
+		case <-activeOrg.CloseSign:
+			if closeActiveOrg(activeOrg) {
+				// The channels stay open, a late KillUser may still signal
+				close(activeOrg.Done)
 				return
 			}
 		}
 	}
 }
 
+// Take the org out of the running ones if still nobody is in it. Once it is out
+// of activeOrgMap it is marked closed, so the ones who got it before can't join.
+func closeActiveOrg(activeOrg *ws.ActiveOrg) bool {
+	mu.Lock()
+	defer mu.Unlock()
+
+	activeOrg.Lock.Lock()
+	defer activeOrg.Lock.Unlock()
+
+	// Someone came in after the sign
+	if len(activeOrg.OnlineUsers) > 0 {
+		return false
+	}
+
+	if activeOrgMap[activeOrg.OrgId] == activeOrg {
+		delete(activeOrgMap, activeOrg.OrgId)
+	}
+	activeOrg.Closed = true
+	return true
+}
+
 // The websocket service that wrapping the qortex Service, which can invoke the api methods
 type WsService struct {
 	services.Service
@@ -122,16 +223,57 @@ func MakeWsService(orgIdHex, userIdHex string) (wsService *WsService, err error)
 	return
 }
 
+// Like MakeWsService, but the user doesn't need to be online on this node,
+// e.g. the sender of the entry handled by the nsq consumers.
+// The org is only loaded, not activated, if nobody is online in it here.
+func MakeSenderWsService(orgIdHex, userIdHex string) (wsService *WsService, err error) {
+
+	orgId, err := utils.ToObjectId(orgIdHex)
+	if err != nil {
+		utils.PrintStackAndError(err)
+		return
+	}
+
+	userId, err := utils.ToObjectId(userIdHex)
+	if err != nil {
+		utils.PrintStackAndError(err)
+		return
+	}
+
+	wsService = new(WsService)
+
+	if activeOrg := findLocalActiveOrg(orgIdHex); activeOrg != nil {
+		wsService.CurrentOrg = activeOrg.Organization
+		wsService.AllDBs = activeOrg.AllDBs
+
+		if onlineUser, _ := activeOrg.GetOnlineUserById(userId); onlineUser != nil {
+			wsService.OnlineUser = onlineUser
+			wsService.LoggedInUser = onlineUser.User
+			return
+		}
+	} else if wsService.CurrentOrg, wsService.AllDBs, err = loadOrg(orgId); err != nil {
+		return
+	}
+
+	wsService.LoggedInUser, err = users.FindById(wsService.CurrentOrg.Database, userId)
+	if err != nil {
+		utils.PrintStackAndError(err)
+		return
+	}
+	return
+}
+
+// The users online on this node, the orgs nobody is in aren't activated
 func GetOnlineUsersByOrgIds(orgIds []string) map[bson.ObjectId]*ws.OnlineUser {
 	onlineUsers := make(map[bson.ObjectId]*ws.OnlineUser)
 	for _, orgId := range orgIds {
-		org, _ := MyActiveOrg(orgId)
+		org := findLocalActiveOrg(orgId)
 		if org == nil {
 			continue
 		}
 
-		for key, onlineUser := range org.OnlineUsers {
-			onlineUsers[key] = onlineUser
+		for _, onlineUser := range org.OnlineUserList() {
+			onlineUsers[onlineUser.User.Id] = onlineUser
 		}
 	}
 	return onlineUsers
@@ -0,0 +1,104 @@
+package services
+
+import (
+	"github.com/kobeld/qortex-realtime/models/ws"
+	"github.com/theplant/qortex/users"
+	"labix.org/v2/mgo/bson"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A running org whose users are cleaned up right after their last connection
+func newRunningTestActiveOrg() *ws.ActiveOrg {
+	activeOrg := newTestActiveOrg()
+	cfg := *config
+	cfg.OnlineUserCloseDuration.Duration = time.Millisecond
+	activeOrg.Config = &cfg
+	go runActiveOrg(activeOrg)
+	return activeOrg
+}
+
+func waitUntil(t *testing.T, what string, done func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestActiveOrgClosesAfterTheLastUser(t *testing.T) {
+	activeOrg := newRunningTestActiveOrg()
+	defer removeTestActiveOrg(activeOrg)
+
+	onlineUser, conn := newTestUser(activeOrg)
+	onlineUser.KillConnection(conn)
+
+	waitUntil(t, "the org to close", func() bool {
+		return findLocalActiveOrg(activeOrg.OrgId) == nil
+	})
+
+	// The ones who got the org before it closed can't join it any more
+	id := bson.NewObjectId()
+	_, _, err := activeOrg.GetOrInitOnlineUser(&users.User{Id: id}, nil, ws.NO_RESUME)
+	if err != ws.ErrOrgClosed {
+		t.Fatalf("expected ErrOrgClosed, got %v", err)
+	}
+}
+
+func TestActiveOrgStaysWhenSomeoneJoinsAfterTheSign(t *testing.T) {
+	activeOrg := newTestActiveOrg()
+	defer removeTestActiveOrg(activeOrg)
+
+	newTestUser(activeOrg)
+	activeOrg.CloseSign <- true
+	go runActiveOrg(activeOrg)
+
+	// The org takes the sign, but isn't empty
+	waitUntil(t, "the sign to be taken", func() bool {
+		return len(activeOrg.CloseSign) == 0
+	})
+	if findLocalActiveOrg(activeOrg.OrgId) != activeOrg {
+		t.Fatal("expected the org to keep running")
+	}
+}
+
+// Run with -race: the users join and leave while the org broadcasts
+func TestActiveOrgJoinLeaveBroadcast(t *testing.T) {
+	activeOrg := newRunningTestActiveOrg()
+	defer removeTestActiveOrg(activeOrg)
+
+	// Keeps the org running until the end
+	anchor, anchorConn := newTestUser(activeOrg)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			onlineUser, conn := newTestUser(activeOrg)
+			onlineUser.KillConnection(conn)
+		}()
+		go func() {
+			defer wg.Done()
+			activeOrg.BroadcastPush(CountNotification{Method: COUNTER_REFRESH})
+		}()
+	}
+	wg.Wait()
+
+	waitUntil(t, "the users to be cleaned up", func() bool {
+		return len(activeOrg.OnlineUserList()) == 1
+	})
+
+	anchor.KillConnection(anchorConn)
+	waitUntil(t, "the org to close", func() bool {
+		return findLocalActiveOrg(activeOrg.OrgId) == nil
+	})
+
+	// A late broadcast neither panics nor blocks
+	if activeOrg.BroadcastPush(CountNotification{Method: COUNTER_REFRESH}) {
+		t.Fatal("expected the broadcast to a closed org to fail")
+	}
+}
@@ -0,0 +1,95 @@
+package services
+
+import (
+	"errors"
+	"github.com/theplant/qortex/members"
+	"github.com/theplant/qortex/organizations"
+	"github.com/theplant/qortex/users"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+)
+
+var (
+	ErrNotAMember      = errors.New("Not a member of the organization")
+	ErrAccountDisabled = errors.New("The account is disabled")
+	ErrSharedGuest     = errors.New("A guest of the shared groups, not a member of the organization")
+)
+
+// The lookups the authorization needs, swappable with fakes
+type Directory interface {
+	FindOrg(orgId bson.ObjectId) (*organizations.Organization, error)
+	FindUser(org *organizations.Organization, userId bson.ObjectId) (*users.User, error)
+	IsDisabled(user *users.User) bool
+}
+
+var directory Directory = new(mongoDirectory)
+
+type mongoDirectory struct{}
+
+func (this *mongoDirectory) FindOrg(orgId bson.ObjectId) (*organizations.Organization, error) {
+	return organizations.FindById(orgId)
+}
+
+func (this *mongoDirectory) FindUser(org *organizations.Organization, userId bson.ObjectId) (*users.User, error) {
+	return users.FindById(org.Database, userId)
+}
+
+func (this *mongoDirectory) IsDisabled(user *users.User) bool {
+	return user.IsDisabled()
+}
+
+// Find the organization and check the member can join it, before it is activated
+func authorizeOrgMember(orgId bson.ObjectId, member *members.Member) (user *users.User, err error) {
+	org, err := directory.FindOrg(orgId)
+	if err != nil {
+		return
+	}
+	return authorizeMember(org, member)
+}
+
+// Check the member can join the organization. Only its own users can, the
+// users of the embedded organizations (shared groups) would see everyone
+// online in it, they get ErrSharedGuest and connect to their own organization.
+func authorizeMember(org *organizations.Organization, member *members.Member) (user *users.User, err error) {
+
+	user, err = directory.FindUser(org, member.Id)
+	if err == nil {
+		if directory.IsDisabled(user) {
+			user, err = nil, ErrAccountDisabled
+		}
+		return
+	}
+	if err != mgo.ErrNotFound {
+		return
+	}
+
+	for _, embedOrgId := range org.EmbededOrgIds {
+		embedOrg, e := directory.FindOrg(embedOrgId)
+		if e != nil {
+			if e != mgo.ErrNotFound {
+				err = e
+				return
+			}
+			continue
+		}
+
+		user, e = directory.FindUser(embedOrg, member.Id)
+		if e == mgo.ErrNotFound {
+			continue
+		}
+		if e != nil {
+			err = e
+			return
+		}
+
+		if directory.IsDisabled(user) {
+			user, err = nil, ErrAccountDisabled
+			return
+		}
+		user, err = nil, ErrSharedGuest
+		return
+	}
+
+	user, err = nil, ErrNotAMember
+	return
+}
@@ -0,0 +1,145 @@
+package services
+
+import (
+	"errors"
+	"github.com/theplant/qortex/members"
+	"github.com/theplant/qortex/organizations"
+	"github.com/theplant/qortex/users"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"testing"
+)
+
+// The users of each org, without the database
+type fakeDirectory struct {
+	orgs     map[bson.ObjectId]*organizations.Organization
+	users    map[*organizations.Organization]map[bson.ObjectId]*users.User
+	disabled map[bson.ObjectId]bool
+	err      error
+}
+
+func newFakeDirectory() *fakeDirectory {
+	return &fakeDirectory{
+		orgs:     make(map[bson.ObjectId]*organizations.Organization),
+		users:    make(map[*organizations.Organization]map[bson.ObjectId]*users.User),
+		disabled: make(map[bson.ObjectId]bool),
+	}
+}
+
+func (this *fakeDirectory) addOrg(embedOrgIds ...bson.ObjectId) *organizations.Organization {
+	org := &organizations.Organization{Id: bson.NewObjectId(), EmbededOrgIds: embedOrgIds}
+	this.orgs[org.Id] = org
+	this.users[org] = make(map[bson.ObjectId]*users.User)
+	return org
+}
+
+func (this *fakeDirectory) addUser(org *organizations.Organization, userId bson.ObjectId) *users.User {
+	user := &users.User{Id: userId, OriginalOrgId: org.Id.Hex()}
+	this.users[org][userId] = user
+	return user
+}
+
+func (this *fakeDirectory) FindOrg(orgId bson.ObjectId) (*organizations.Organization, error) {
+	if org, ok := this.orgs[orgId]; ok {
+		return org, nil
+	}
+	return nil, mgo.ErrNotFound
+}
+
+func (this *fakeDirectory) FindUser(org *organizations.Organization, userId bson.ObjectId) (*users.User, error) {
+	if this.err != nil {
+		return nil, this.err
+	}
+	if user, ok := this.users[org][userId]; ok {
+		return user, nil
+	}
+	return nil, mgo.ErrNotFound
+}
+
+func (this *fakeDirectory) IsDisabled(user *users.User) bool {
+	return this.disabled[user.Id]
+}
+
+func useDirectory(d Directory) (restore func()) {
+	old := directory
+	directory = d
+	return func() { directory = old }
+}
+
+func TestAuthorizeMember(t *testing.T) {
+	d := newFakeDirectory()
+	defer useDirectory(d)()
+
+	embedOrg := d.addOrg()
+	org := d.addOrg(embedOrg.Id, bson.NewObjectId()) // The second one is gone
+
+	member := d.addUser(org, bson.NewObjectId())
+	disabledMember := d.addUser(org, bson.NewObjectId())
+	d.disabled[disabledMember.Id] = true
+	guest := d.addUser(embedOrg, bson.NewObjectId())
+	disabledGuest := d.addUser(embedOrg, bson.NewObjectId())
+	d.disabled[disabledGuest.Id] = true
+
+	// Removed from the organization, or never in it
+	removedId := bson.NewObjectId()
+
+	cases := []struct {
+		name   string
+		userId bson.ObjectId
+		user   *users.User
+		err    error
+	}{
+		{"member", member.Id, member, nil},
+		{"disabled member", disabledMember.Id, nil, ErrAccountDisabled},
+		{"guest", guest.Id, nil, ErrSharedGuest},
+		{"disabled guest", disabledGuest.Id, nil, ErrAccountDisabled},
+		{"removed member", removedId, nil, ErrNotAMember},
+	}
+
+	for _, c := range cases {
+		user, err := authorizeMember(org, &members.Member{Id: c.userId})
+		if err != c.err {
+			t.Errorf("%s: expected error %v, got %v", c.name, c.err, err)
+			continue
+		}
+		if user != c.user {
+			t.Errorf("%s: expected %v, got %v", c.name, c.user, user)
+		}
+	}
+}
+
+func TestAuthorizeMemberLookupError(t *testing.T) {
+	d := newFakeDirectory()
+	defer useDirectory(d)()
+
+	org := d.addOrg()
+	d.err = errors.New("mongo is down")
+
+	// Not taken as "not a member", the client should retry
+	if _, err := authorizeMember(org, &members.Member{Id: bson.NewObjectId()}); err != d.err {
+		t.Fatalf("expected the lookup error, got %v", err)
+	}
+}
+
+func TestAuthorizeOrgMemberBeforeActivating(t *testing.T) {
+	d := newFakeDirectory()
+	defer useDirectory(d)()
+
+	org := d.addOrg()
+	member := d.addUser(org, bson.NewObjectId())
+
+	if _, err := authorizeOrgMember(org.Id, &members.Member{Id: bson.NewObjectId()}); err != ErrNotAMember {
+		t.Fatalf("expected ErrNotAMember, got %v", err)
+	}
+	if _, err := authorizeOrgMember(bson.NewObjectId(), &members.Member{Id: member.Id}); err != mgo.ErrNotFound {
+		t.Fatalf("expected the unknown org not found, got %v", err)
+	}
+
+	// Only the org document is looked up, the org isn't activated for the check
+	if user, err := authorizeOrgMember(org.Id, &members.Member{Id: member.Id}); err != nil || user != member {
+		t.Fatalf("expected the member, got %v %v", user, err)
+	}
+	if findLocalActiveOrg(org.Id.Hex()) != nil {
+		t.Fatal("expected the org not activated by the check")
+	}
+}
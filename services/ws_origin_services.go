@@ -0,0 +1,69 @@
+package services
+
+import (
+	"errors"
+	"github.com/kobeld/qortex-realtime/configs"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var ErrOriginNotAllowed = errors.New("Origin not allowed")
+
+// Reject the upgrades from the origins out of config.AllowedOrigins.
+// In development the local origins are always allowed.
+func checkOrigin(origin *url.URL, req *http.Request) error {
+	if origin == nil {
+		log.Printf("Websocket: rejected upgrade without origin from %s\n", req.RemoteAddr)
+		return ErrOriginNotAllowed
+	}
+
+	if config.Env == configs.ENV_DEVELOPMENT && isLocalHost(origin.Host) {
+		return nil
+	}
+
+	for _, allowed := range config.AllowedOrigins {
+		if originMatches(allowed, origin) {
+			return nil
+		}
+	}
+
+	log.Printf("Websocket: rejected upgrade from origin %s (%s)\n", origin, req.RemoteAddr)
+	return ErrOriginNotAllowed
+}
+
+// Nil without Origin (the native apps) or with "null" (sandboxed pages, files),
+// the cookie clients get rejected then
+func requestOrigin(req *http.Request) (*url.URL, error) {
+	origin := req.Header.Get("Origin")
+	if origin == "" || origin == "null" {
+		return nil, nil
+	}
+	return url.ParseRequestURI(origin)
+}
+
+// The allowed origin is "scheme://host[:port]", the host can start with "*."
+// to match the sub domains, e.g. "https://*.qortex.com".
+func originMatches(allowed string, origin *url.URL) bool {
+	allowedUrl, err := url.Parse(allowed)
+	if err != nil || !strings.EqualFold(allowedUrl.Scheme, origin.Scheme) {
+		return false
+	}
+
+	allowedHost := strings.ToLower(allowedUrl.Host)
+	host := strings.ToLower(origin.Host)
+
+	if strings.HasPrefix(allowedHost, "*.") {
+		return strings.HasSuffix(host, allowedHost[1:])
+	}
+	return host == allowedHost
+}
+
+func isLocalHost(hostport string) bool {
+	host := hostport
+	if i := strings.LastIndex(hostport, ":"); i >= 0 && !strings.HasSuffix(hostport, "]") {
+		host = hostport[:i]
+	}
+	return host == "localhost" || host == "127.0.0.1" || host == "[::1]"
+}
@@ -0,0 +1,133 @@
+package services
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"github.com/kobeld/qortex-realtime/configs"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func useOriginPolicy(env string, allowed ...string) (restore func()) {
+	oldEnv, oldAllowed := config.Env, config.AllowedOrigins
+	config.Env, config.AllowedOrigins = env, allowed
+	return func() { config.Env, config.AllowedOrigins = oldEnv, oldAllowed }
+}
+
+func TestOriginMatches(t *testing.T) {
+	cases := []struct {
+		allowed string
+		origin  string
+		match   bool
+	}{
+		{"https://qortex.com", "https://qortex.com", true},
+		{"https://qortex.com", "https://QORTEX.com", true},
+		{"https://qortex.com", "http://qortex.com", false},
+		{"https://qortex.com", "https://qortex.com:8443", false},
+		{"https://qortex.com:8443", "https://qortex.com:8443", true},
+		{"https://qortex.com", "https://qortex.com.evil.com", false},
+		{"https://qortex.com", "https://www.qortex.com", false},
+		{"https://*.qortex.com", "https://www.qortex.com", true},
+		{"https://*.qortex.com", "https://a.b.qortex.com", true},
+		{"https://*.qortex.com", "https://qortex.com", false},
+		{"https://*.qortex.com", "https://evilqortex.com", false},
+		{"https://*.qortex.com", "https://www.qortex.com:8443", false},
+		{"https://*.qortex.com", "http://www.qortex.com", false},
+		{"://broken", "https://qortex.com", false},
+	}
+
+	for _, c := range cases {
+		origin, err := url.Parse(c.origin)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if match := originMatches(c.allowed, origin); match != c.match {
+			t.Errorf("%s against %s: expected %v, got %v", c.origin, c.allowed, c.match, match)
+		}
+	}
+}
+
+func TestIsLocalHost(t *testing.T) {
+	cases := []struct {
+		host  string
+		local bool
+	}{
+		{"localhost", true},
+		{"localhost:3000", true},
+		{"127.0.0.1", true},
+		{"127.0.0.1:3000", true},
+		{"[::1]", true},
+		{"[::1]:3000", true},
+		{"localhost.evil.com", false},
+		{"127.0.0.1.evil.com:3000", false},
+		{"qortex.com", false},
+	}
+
+	for _, c := range cases {
+		if local := isLocalHost(c.host); local != c.local {
+			t.Errorf("%s: expected %v, got %v", c.host, c.local, local)
+		}
+	}
+}
+
+func newHandshakeRequest(origin, protocol string, cookie bool) *http.Request {
+	req, _ := http.NewRequest("GET", "http://realtime.qortex.com/conn", nil)
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	if protocol != "" {
+		req.Header.Set("Sec-WebSocket-Protocol", protocol)
+	}
+	if cookie {
+		req.AddCookie(&http.Cookie{Name: "qortex", Value: "session"})
+	}
+	return req
+}
+
+func TestHandshake(t *testing.T) {
+	defer useOriginPolicy(configs.ENV_PRODUCTION, "https://*.qortex.com")()
+
+	// The token clients get the error of their token, their origin isn't checked
+	cases := []struct {
+		name     string
+		origin   string
+		protocol string
+		cookie   bool
+		err      error
+	}{
+		{"cookie from an allowed origin", "https://www.qortex.com", "", true, nil},
+		{"cookie from another site", "https://evil.com", "", true, ErrOriginNotAllowed},
+		{"cookie from another port", "https://www.qortex.com:8443", "", true, ErrOriginNotAllowed},
+		{"cookie without origin", "", "", true, ErrOriginNotAllowed},
+		{"cookie from a null origin", "null", "", true, ErrOriginNotAllowed},
+		{"cookie from localhost in production", "http://localhost:3000", "", true, ErrOriginNotAllowed},
+		{"token without origin", "", BEARER_PROTOCOL, false, ErrInvalidBearer},
+		{"token from another site", "https://evil.com", BEARER_PROTOCOL, true, ErrInvalidBearer},
+	}
+
+	for _, c := range cases {
+		err := Handshake(new(websocket.Config), newHandshakeRequest(c.origin, c.protocol, c.cookie))
+		if err != c.err {
+			t.Errorf("%s: expected %v, got %v", c.name, c.err, err)
+		}
+	}
+}
+
+func TestHandshakeAllowsLocalOriginsInDevelopment(t *testing.T) {
+	defer useOriginPolicy(configs.ENV_DEVELOPMENT)()
+
+	if err := Handshake(new(websocket.Config), newHandshakeRequest("http://localhost:3000", "", true)); err != nil {
+		t.Fatalf("expected localhost allowed, got %v", err)
+	}
+	if err := Handshake(new(websocket.Config), newHandshakeRequest("https://evil.com", "", true)); err != ErrOriginNotAllowed {
+		t.Fatalf("expected the other sites rejected, got %v", err)
+	}
+}
+
+func TestHandshakeRejectsBrokenOrigin(t *testing.T) {
+	defer useOriginPolicy(configs.ENV_PRODUCTION, "https://*.qortex.com")()
+
+	if err := Handshake(new(websocket.Config), newHandshakeRequest("not a url", "", true)); err == nil {
+		t.Fatal("expected an error for a broken origin")
+	}
+}
@@ -0,0 +1,223 @@
+package services
+
+import (
+	"github.com/kobeld/qortex-realtime/cluster"
+	"github.com/kobeld/qortex-realtime/models/ws"
+	"time"
+)
+
+const (
+	PRESENCE_ONLINE  = "Presence.Online"
+	PRESENCE_OFFLINE = "Presence.Offline"
+	PRESENCE_STATE   = "Presence.State"
+
+	PRESENCE_TOPIC = "presence"
+)
+
+type PresenceUser struct {
+	UserId       string
+	OrgId        string
+	State        string
+	LastActiveAt time.Time
+}
+
+// Pushed to the subscribers when a user comes online in an organization,
+// goes offline after the grace period (so page reloads don't flap), or
+// the state aggregated over all the user's connections changes
+type PresenceNotification struct {
+	Method string
+	PresenceUser
+}
+
+func (this PresenceNotification) PushMethod() string {
+	return this.Method
+}
+
+type Presence int
+
+type PresenceInput struct {
+	RpcInput
+}
+
+type PresenceList struct {
+	Users []PresenceUser
+}
+
+type PresenceReportInput struct {
+	RpcInput
+	State string
+}
+
+type PresenceDndInput struct {
+	RpcInput
+	Enabled bool
+}
+
+// The online users of the current organization and its shared organizations
+func (this *Presence) List(input *PresenceInput, reply *PresenceList) (err error) {
+	reply.Users = listPresence(input.Context().ActiveOrg)
+	return
+}
+
+// Get the Presence.Online/Offline pushes on this connection, replies the current list
+func (this *Presence) Subscribe(input *PresenceInput, reply *PresenceList) (err error) {
+	input.Context().Conn.Subscribe(PRESENCE_TOPIC)
+	reply.Users = listPresence(input.Context().ActiveOrg)
+	return
+}
+
+func (this *Presence) Unsubscribe(input *PresenceInput, reply *bool) (err error) {
+	input.Context().Conn.Unsubscribe(PRESENCE_TOPIC)
+	*reply = true
+	return
+}
+
+// The client reports the activity of this connection: active, idle or away
+func (this *Presence) Report(input *PresenceReportInput, reply *bool) (err error) {
+	if !ws.IsReportableState(input.State) {
+		return InvalidInput("Unknown state: " + input.State)
+	}
+
+	ctx := input.Context()
+	updatePresenceState(ctx.OnlineUser, func() {
+		ctx.Conn.ReportState(input.State)
+	})
+	*reply = true
+	return
+}
+
+// The manual do-not-disturb status, it overrides the reported states
+func (this *Presence) SetDoNotDisturb(input *PresenceDndInput, reply *bool) (err error) {
+	onlineUser := input.Context().OnlineUser
+	updatePresenceState(onlineUser, func() {
+		onlineUser.SetDoNotDisturb(input.Enabled)
+	})
+	*reply = true
+	return
+}
+
+// Apply the change, tell the other nodes and the subscribers if the
+// aggregated state of the user changes
+func updatePresenceState(onlineUser *ws.OnlineUser, change func()) {
+	user := newPresenceUser(onlineUser)
+	before, _ := presenceStatus(user)
+	change()
+	after, _ := presenceStatus(user)
+
+	if before.State == after.State {
+		return
+	}
+
+	announcePresence(onlineUser, cluster.KIND_ONLINE)
+	user.State, user.LastActiveAt = after.State, after.LastActiveAt
+	pushPresence(PRESENCE_STATE, user)
+}
+
+func listPresence(activeOrg *ws.ActiveOrg) (users []PresenceUser) {
+	orgIds := []string{activeOrg.OrgId}
+	for _, embedOrgId := range activeOrg.Organization.EmbededOrgIds {
+		orgIds = append(orgIds, embedOrgId.Hex())
+	}
+
+	for _, orgId := range orgIds {
+		statuses := make(map[string][]cluster.Status)
+
+		if localOrg := findLocalActiveOrg(orgId); localOrg != nil {
+			for _, onlineUser := range localOrg.OnlineUserList() {
+				userId := onlineUser.User.Id.Hex()
+				statuses[userId] = append(statuses[userId], localStatus(onlineUser))
+			}
+		}
+
+		if presence != nil {
+			for userId, remotes := range presence.OrgUsers(orgId) {
+				statuses[userId] = append(statuses[userId], remotes...)
+			}
+		}
+
+		for userId, all := range statuses {
+			status := mergeStatuses(all)
+			users = append(users, PresenceUser{
+				UserId:       userId,
+				OrgId:        orgId,
+				State:        status.State,
+				LastActiveAt: status.LastActiveAt,
+			})
+		}
+	}
+	return
+}
+
+// Hooked on ActiveOrg.OnUserOnline
+func userCameOnline(onlineUser *ws.OnlineUser) {
+	announcePresence(onlineUser, cluster.KIND_ONLINE)
+
+	user := newPresenceUser(onlineUser)
+	if !isOnlineInOtherNodes(user) {
+		CancelOfflineUser(onlineUser)
+
+		status, _ := presenceStatus(user)
+		user.State, user.LastActiveAt = status.State, status.LastActiveAt
+		pushPresence(PRESENCE_ONLINE, user)
+	}
+}
+
+// Hooked on ActiveOrg.OnUserOffline
+func userWentOffline(onlineUser *ws.OnlineUser) {
+	announcePresence(onlineUser, cluster.KIND_OFFLINE)
+
+	user := newPresenceUser(onlineUser)
+	if !isOnlineInOtherNodes(user) {
+		_, user.LastActiveAt = onlineUser.PresenceState()
+		pushPresence(PRESENCE_OFFLINE, user)
+		PutOfflineUserIntoQueue(onlineUser, time.Now())
+	}
+}
+
+func newPresenceUser(onlineUser *ws.OnlineUser) PresenceUser {
+	return PresenceUser{UserId: onlineUser.User.Id.Hex(), OrgId: onlineUser.InActivedOrg.OrgId}
+}
+
+func localStatus(onlineUser *ws.OnlineUser) (status cluster.Status) {
+	status.State, status.LastActiveAt = onlineUser.PresenceState()
+	return
+}
+
+// The state of the user over this node and the others
+func presenceStatus(user PresenceUser) (status cluster.Status, online bool) {
+	var all []cluster.Status
+	if onlineUser := findLocalOnlineUser(user.OrgId, user.UserId); onlineUser != nil {
+		all = append(all, localStatus(onlineUser))
+	}
+	if presence != nil {
+		all = append(all, presence.Statuses(user.OrgId, user.UserId)...)
+	}
+	return mergeStatuses(all), len(all) > 0
+}
+
+func mergeStatuses(statuses []cluster.Status) (status cluster.Status) {
+	for _, s := range statuses {
+		status.State = ws.MergeState(status.State, s.State)
+		status.LastActiveAt = ws.LaterTime(status.LastActiveAt, s.LastActiveAt)
+	}
+	return
+}
+
+func isOnlineInOtherNodes(user PresenceUser) bool {
+	return presence != nil && presence.IsOnlineIn(user.OrgId, user.UserId)
+}
+
+// Push to the presence subscribers of the organization and the ones sharing it
+func pushPresence(method string, user PresenceUser) {
+	reply := PresenceNotification{Method: method, PresenceUser: user}
+	pushToLocalTopics(user.OrgId, []string{PRESENCE_TOPIC}, reply, "")
+}
+
+func embedsOrg(activeOrg *ws.ActiveOrg, orgId string) bool {
+	for _, embedOrgId := range activeOrg.Organization.EmbededOrgIds {
+		if embedOrgId.Hex() == orgId {
+			return true
+		}
+	}
+	return false
+}
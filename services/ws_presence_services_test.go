@@ -0,0 +1,38 @@
+package services
+
+import (
+	"github.com/kobeld/qortex-realtime/models/ws"
+	"testing"
+	"time"
+)
+
+func TestOfflinePresenceKeepsLastActiveAt(t *testing.T) {
+	activeOrg := newTestActiveOrg()
+	defer removeTestActiveOrg(activeOrg)
+
+	_, watcherConn := newTestUser(activeOrg)
+	watcherConn.Subscribe(PRESENCE_TOPIC)
+
+	onlineUser, conn := newTestUser(activeOrg)
+	conn.ReportState(ws.STATE_ACTIVE)
+	_, activeAt := conn.State()
+
+	onlineUser.KillConnection(conn)
+	activeOrg.KillUser(onlineUser.User.Id)
+	userWentOffline(onlineUser)
+
+	var offline *PresenceNotification
+	for watcherConn.Queue.Len() > 0 {
+		msg, _ := watcherConn.Queue.Pop()
+		if push, ok := msg.(PresenceNotification); ok && push.Method == PRESENCE_OFFLINE {
+			offline = &push
+		}
+	}
+
+	if offline == nil {
+		t.Fatal("expected a Presence.Offline push")
+	}
+	if !offline.LastActiveAt.Equal(activeAt) {
+		t.Fatalf("expected LastActiveAt %s, got %s", activeAt.Format(time.RFC3339Nano), offline.LastActiveAt.Format(time.RFC3339Nano))
+	}
+}
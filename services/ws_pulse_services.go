@@ -1,20 +1,55 @@
 package services
 
 import (
-	"github.com/theplant/qortex/utils"
+	"github.com/kobeld/qortex-realtime/models/ws"
+	"time"
 )
 
+const (
+	PULSE_PING = "Pulse.Ping"
+)
+
+// Pushed every config.HeartbeatInterval, the client should answer with
+// Pulse.Pong (or any other call) before config.IdleTimeout
+type PulseNotification struct {
+	Method string
+	Time   time.Time
+}
+
+func (this PulseNotification) PushMethod() string {
+	return this.Method
+}
+
 type Pulse int
 
-type PulseInput struct{}
+type PulseInput struct {
+	RpcInput
+}
 
 func (this *Pulse) Send(input *PulseInput, reply *string) (err error) {
-
-	defer func() {
-		if e := recover(); e != nil {
-			utils.PrintStackAndError(e.(error))
-		}
-	}()
 	*reply = "Pulse.Get"
 	return
 }
+
+// The client answering Pulse.Ping, usually as a notification
+func (this *Pulse) Pong(input *PulseInput, reply *string) (err error) {
+	*reply = "Pulse.Pong"
+	return
+}
+
+// Ping the client until the connection is closed. A half-open connection
+// stops answering, then serveRpc hits its read deadline and the connection is killed.
+func keepAlive(wsConn *ws.Connection) {
+	ticker := time.NewTicker(config.HeartbeatInterval.Duration)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		if wsConn.IsClosed() {
+			return
+		}
+		if !wsConn.Push(PulseNotification{Method: PULSE_PING, Time: now}) {
+			wsConn.Owner.KillConnection(wsConn)
+			return
+		}
+	}
+}
@@ -0,0 +1,141 @@
+package services
+
+import (
+	"errors"
+	"github.com/kobeld/qortex-realtime/configs"
+	"github.com/kobeld/qortex-realtime/models/ws"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+var errReadTimeout = errors.New("read timeout")
+
+// The client side of a connection, sending the messages put in the channel.
+// Reading fails once the deadline passes, or with io.EOF when the channel is closed.
+type fakeMessageReader struct {
+	messages chan []byte
+	deadline time.Time
+	lock     sync.Mutex
+}
+
+func newFakeMessageReader() *fakeMessageReader {
+	return &fakeMessageReader{messages: make(chan []byte)}
+}
+
+func (this *fakeMessageReader) SetReadDeadline(t time.Time) error {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.deadline = t
+	return nil
+}
+
+func (this *fakeMessageReader) ReadMessage() ([]byte, error) {
+	this.lock.Lock()
+	deadline := this.deadline
+	this.lock.Unlock()
+
+	select {
+	case data, ok := <-this.messages:
+		if !ok {
+			return nil, io.EOF
+		}
+		return data, nil
+	case <-time.After(deadline.Sub(time.Now())):
+		return nil, errReadTimeout
+	}
+}
+
+func useHeartbeat(interval, idleTimeout time.Duration) (restore func()) {
+	oldInterval, oldIdleTimeout := config.HeartbeatInterval.Duration, config.IdleTimeout.Duration
+	config.HeartbeatInterval.Duration, config.IdleTimeout.Duration = interval, idleTimeout
+	return func() {
+		config.HeartbeatInterval.Duration, config.IdleTimeout.Duration = oldInterval, oldIdleTimeout
+	}
+}
+
+// Like BuildConnection once the connection is set up
+func serveTestConnection(reader messageReader, onlineUser *ws.OnlineUser, conn *ws.Connection) {
+	serveRpc(reader, conn)
+	onlineUser.KillConnection(conn)
+}
+
+func waitUntilOffline(t *testing.T, activeOrg *ws.ActiveOrg, onlineUser *ws.OnlineUser) {
+	waitUntil(t, "the user removed", func() bool {
+		_, err := activeOrg.GetOnlineUserById(onlineUser.User.Id)
+		return err == ws.ErrUserNotOnline
+	})
+}
+
+func TestIdleConnectionKilled(t *testing.T) {
+	defer useHeartbeat(5*time.Millisecond, 30*time.Millisecond)()
+
+	activeOrg := newOfflineTestActiveOrg(10 * time.Millisecond)
+	defer removeTestActiveOrg(activeOrg)
+	onlineUser, conn := newTestUser(activeOrg)
+
+	start := time.Now()
+	serveRpc(newFakeMessageReader(), conn)
+	if elapsed := time.Since(start); elapsed < config.IdleTimeout.Duration {
+		t.Fatalf("expected the connection kept until the idle timeout, it took %s", elapsed)
+	}
+
+	// Pinged while waiting for the client
+	methods := popPushes(conn)
+	if len(methods) == 0 || methods[0] != PULSE_PING {
+		t.Fatalf("expected the pings, got %v", methods)
+	}
+
+	onlineUser.KillConnection(conn)
+	if !conn.IsClosed() {
+		t.Fatal("expected the connection closed")
+	}
+	waitUntilOffline(t, activeOrg, onlineUser)
+}
+
+// Each message read gives the client another IdleTimeout
+func TestAnsweringConnectionKept(t *testing.T) {
+	defer useHeartbeat(5*time.Millisecond, 20*time.Millisecond)()
+
+	activeOrg := newOfflineTestActiveOrg(10 * time.Millisecond)
+	defer removeTestActiveOrg(activeOrg)
+	onlineUser, conn := newTestUser(activeOrg)
+
+	reader := newFakeMessageReader()
+	go func() {
+		for i := 0; i < 4; i++ {
+			time.Sleep(10 * time.Millisecond)
+			reader.messages <- []byte(`{"jsonrpc":"2.0","method":"Pulse.Pong"}`)
+		}
+		close(reader.messages)
+	}()
+
+	start := time.Now()
+	serveTestConnection(reader, onlineUser, conn)
+	if elapsed := time.Since(start); elapsed < 40*time.Millisecond {
+		t.Fatalf("expected the connection kept while answering, it took %s", elapsed)
+	}
+	waitUntilOffline(t, activeOrg, onlineUser)
+}
+
+// A ping that can't be queued kills the connection, the user goes after the grace period
+func TestMissedPingKillsConnection(t *testing.T) {
+	defer useHeartbeat(5*time.Millisecond, time.Minute)()
+
+	activeOrg := newOfflineTestActiveOrg(10 * time.Millisecond)
+	defer removeTestActiveOrg(activeOrg)
+	activeOrg.Config.SendBufferSize = 1
+	activeOrg.Config.OverflowPolicy = configs.OVERFLOW_DISCONNECT
+	onlineUser, conn := newTestUser(activeOrg)
+
+	// The client stopped reading
+	conn.Push(PulseNotification{Method: PULSE_PING, Time: time.Now()})
+
+	go keepAlive(conn)
+	waitUntil(t, "the connection killed", conn.IsClosed)
+	if count := onlineUser.ConnectionCount(); count != 0 {
+		t.Fatalf("expected the connection removed, %d left", count)
+	}
+	waitUntilOffline(t, activeOrg, onlineUser)
+}
@@ -0,0 +1,114 @@
+package services
+
+import (
+	"errors"
+	"github.com/kobeld/qortex-realtime/models/ws"
+	"labix.org/v2/mgo/bson"
+	"time"
+)
+
+var (
+	ErrIdentityMismatch = errors.New("The ids don't match the connection")
+	ErrNoRpcContext     = errors.New("The call has no rpc context")
+	ErrRpcTimeout       = errors.New("The call took too long")
+)
+
+// Everything a RPC handler knows about the call. The client gets a timeout
+// once the Deadline passes, the handlers doing several steps can stop early.
+type RpcContext struct {
+	Conn       *ws.Connection
+	OnlineUser *ws.OnlineUser
+	ActiveOrg  *ws.ActiveOrg
+	ConnId     string
+	Method     string
+	TraceId    string
+	Deadline   time.Time
+}
+
+func (this *RpcContext) Expired() bool {
+	return time.Now().After(this.Deadline)
+}
+
+// ErrRpcTimeout once the deadline passed. The handlers check it before their
+// side effects: the client has got the timeout and may retry the call.
+func (this *RpcContext) CheckDeadline() error {
+	if this.Expired() {
+		return ErrRpcTimeout
+	}
+	return nil
+}
+
+// The service acting as the user of the connection
+func (this *RpcContext) WsService() (wsService *WsService, err error) {
+	if this == nil {
+		err = ErrNoRpcContext
+		return
+	}
+	if this.Conn.IsClosed() {
+		err = ws.ErrUserNotOnline
+		return
+	}
+
+	wsService = new(WsService)
+	wsService.OnlineUser = this.OnlineUser
+	wsService.LoggedInUser = this.OnlineUser.User
+	wsService.CurrentOrg = this.ActiveOrg.Organization
+	wsService.AllDBs = this.ActiveOrg.AllDBs
+	return
+}
+
+// Embedded by every RPC input, the codec hands it the context of the call
+type RpcInput struct {
+	ctx *RpcContext
+}
+
+func (this *RpcInput) Context() *RpcContext {
+	return this.ctx
+}
+
+func (this *RpcInput) setContext(ctx *RpcContext) error {
+	this.ctx = ctx
+	return nil
+}
+
+type contextReceiver interface {
+	setContext(ctx *RpcContext) error
+}
+
+func newRpcContext(conn *ws.Connection, method string) *RpcContext {
+	return &RpcContext{
+		Conn:       conn,
+		OnlineUser: conn.Owner,
+		ActiveOrg:  conn.Owner.InActivedOrg,
+		ConnId:     conn.Id,
+		Method:     method,
+		TraceId:    bson.NewObjectId().Hex(),
+		Deadline:   time.Now().Add(config.RpcTimeout.Duration),
+	}
+}
+
+// Hand the args the context of the call. The inputs overriding setContext can reject the call.
+func bindRpcContext(ctx *RpcContext) func(args interface{}) error {
+	return func(args interface{}) error {
+		if receiver, ok := args.(contextReceiver); ok {
+			return receiver.setContext(ctx)
+		}
+		return nil
+	}
+}
+
+// Fill the empty ids with the connection's, reject the different ones.
+// The ids in the payload are only checked, never trusted.
+func bindIds(ctx *RpcContext, userId, orgId *string) error {
+	if *userId == "" {
+		*userId = ctx.OnlineUser.User.Id.Hex()
+	}
+	if *orgId == "" {
+		*orgId = ctx.ActiveOrg.OrgId
+	}
+
+	if *userId != ctx.OnlineUser.User.Id.Hex() || *orgId != ctx.ActiveOrg.OrgId {
+		return ErrIdentityMismatch
+	}
+	return nil
+}
@@ -0,0 +1,116 @@
+package services
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/kobeld/qortex-realtime/jsonrpc2"
+	"labix.org/v2/mgo/bson"
+	"sync"
+	"testing"
+)
+
+// The inputs binding the reader or the logged in user, with the org
+type boundInput interface {
+	contextReceiver
+	ids() (userId, orgId string)
+}
+
+type testRefreshInput struct{ RefreshInput }
+
+func (this *testRefreshInput) ids() (string, string) {
+	return this.LoggedInUserId, this.OrganizationId
+}
+
+type testReadEntryInput struct{ ReadEntryInput }
+
+func (this *testReadEntryInput) ids() (string, string) {
+	return this.ReaderId, this.OrganizationId
+}
+
+type testReadNotificationInput struct{ ReadNotificationInput }
+
+func (this *testReadNotificationInput) ids() (string, string) {
+	return this.ReaderId, this.OrganizationId
+}
+
+func TestBindIds(t *testing.T) {
+	activeOrg := newTestActiveOrg()
+	defer removeTestActiveOrg(activeOrg)
+	onlineUser, conn := newTestUser(activeOrg)
+
+	userId, orgId := onlineUser.User.Id.Hex(), activeOrg.OrgId
+	otherId := bson.NewObjectId().Hex()
+
+	cases := []struct {
+		name          string
+		userId, orgId string
+		err           error
+	}{
+		{"empty ids", "", "", nil},
+		{"same ids", userId, orgId, nil},
+		{"empty user", "", orgId, nil},
+		{"other user", otherId, orgId, ErrIdentityMismatch},
+		{"other org", userId, otherId, ErrIdentityMismatch},
+		{"other org, empty user", "", otherId, ErrIdentityMismatch},
+	}
+
+	for _, c := range cases {
+		inputs := []boundInput{
+			&testRefreshInput{RefreshInput{LoggedInUserId: c.userId, OrganizationId: c.orgId}},
+			&testReadEntryInput{ReadEntryInput{ReaderId: c.userId, OrganizationId: c.orgId}},
+			&testReadNotificationInput{ReadNotificationInput{ReaderId: c.userId, OrganizationId: c.orgId}},
+		}
+
+		for _, input := range inputs {
+			name := fmt.Sprintf("%s %T", c.name, input)
+			if err := input.setContext(newRpcContext(conn, "")); err != c.err {
+				t.Errorf("%s: expected %v, got %v", name, c.err, err)
+				continue
+			}
+			if c.err != nil {
+				continue
+			}
+
+			// Filled from the connection
+			if gotUserId, gotOrgId := input.ids(); gotUserId != userId || gotOrgId != orgId {
+				t.Errorf("%s: expected the ids of the connection, got %s %s", name, gotUserId, gotOrgId)
+			}
+		}
+	}
+}
+
+var registerCounter sync.Once
+
+// The mismatched ids are rejected before the call, as invalid_input
+func TestMismatchedIdsRejected(t *testing.T) {
+	registerCounter.Do(func() { rpcRouter.Register(new(Counter)) })
+
+	activeOrg := newTestActiveOrg()
+	defer removeTestActiveOrg(activeOrg)
+	onlineUser, conn := newTestUser(activeOrg)
+	otherId := bson.NewObjectId().Hex()
+
+	cases := []struct {
+		method string
+		params string
+	}{
+		{"Counter.Refresh", fmt.Sprintf(`{"LoggedInUserId":%q}`, otherId)},
+		{"Counter.Refresh", fmt.Sprintf(`{"OrganizationId":%q}`, otherId)},
+		{"Counter.ReadEntry", fmt.Sprintf(`{"EntryId":"e","ReaderId":%q}`, otherId)},
+		{"Counter.ReadEntry", fmt.Sprintf(`{"EntryId":"e","ReaderId":%q,"OrganizationId":%q}`, onlineUser.User.Id.Hex(), otherId)},
+		{"Counter.ReadNotificationItem", fmt.Sprintf(`{"NotificationItemId":"n","ReaderId":%q}`, otherId)},
+		{"Counter.ReadNotificationItem", fmt.Sprintf(`{"NotificationItemId":"n","OrganizationId":%q}`, otherId)},
+	}
+
+	for _, c := range cases {
+		req := fmt.Sprintf(`{"jsonrpc":"2.0","id":1,"method":%q,"params":%s}`, c.method, c.params)
+		resp := handleRpcRequest(conn, json.RawMessage(req), newTestRpcSlot(1))
+		if resp == nil || resp.Error == nil || resp.Error.Code != jsonrpc2.INVALID_PARAMS {
+			t.Errorf("%s %s: expected invalid params, got %+v", c.method, c.params, resp)
+			continue
+		}
+		if data, ok := resp.Error.Data.(RpcErrorData); !ok || data.Kind != RPC_ERR_INVALID_INPUT {
+			t.Errorf("%s %s: expected kind %s, got %+v", c.method, c.params, RPC_ERR_INVALID_INPUT, resp.Error.Data)
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package services
+
+import (
+	"fmt"
+	"github.com/kobeld/qortex-realtime/jsonrpc2"
+	"github.com/kobeld/qortex-realtime/models/ws"
+	"labix.org/v2/mgo"
+	"log"
+	"runtime/debug"
+)
+
+// Kinds of the RPC errors, sent in the data of the JSON-RPC error object
+const (
+	RPC_ERR_NOT_ONLINE    = "not_online"
+	RPC_ERR_INVALID_INPUT = "invalid_input"
+	RPC_ERR_NOT_FOUND     = "not_found"
+	RPC_ERR_FORBIDDEN     = "forbidden"
+	RPC_ERR_TIMEOUT       = "timeout"
+	RPC_ERR_INTERNAL      = "internal"
+)
+
+var rpcErrorCodes = map[string]int{
+	RPC_ERR_NOT_ONLINE:    -32001,
+	RPC_ERR_INVALID_INPUT: jsonrpc2.INVALID_PARAMS,
+	RPC_ERR_NOT_FOUND:     -32004,
+	RPC_ERR_FORBIDDEN:     -32003,
+	RPC_ERR_TIMEOUT:       -32008,
+	RPC_ERR_INTERNAL:      jsonrpc2.INTERNAL_ERROR,
+}
+
+// The error returned by the RPC methods, telling the client what went wrong
+type RpcError struct {
+	Kind    string
+	Message string
+}
+
+func (this *RpcError) Error() string {
+	return this.Kind + ": " + this.Message
+}
+
+func NewRpcError(kind, message string) *RpcError {
+	return &RpcError{Kind: kind, Message: message}
+}
+
+func InvalidInput(message string) *RpcError {
+	return NewRpcError(RPC_ERR_INVALID_INPUT, message)
+}
+
+// The data of the JSON-RPC error object. CorrelationId is the trace id
+// of the call, the same one in the server log.
+type RpcErrorData struct {
+	Kind          string
+	CorrelationId string
+}
+
+// Turn whatever the call returns into a JSON-RPC error object. The
+// unexpected errors are logged and only their correlation id is exposed.
+func toRpcError(err error, ctx *RpcContext) *jsonrpc2.Error {
+	if rpcErr, ok := err.(*jsonrpc2.Error); ok {
+		return rpcErr
+	}
+
+	var rpcErr *RpcError
+	switch e := err.(type) {
+	case *RpcError:
+		rpcErr = e
+	default:
+		switch err {
+		case ws.ErrUserNotOnline:
+			rpcErr = NewRpcError(RPC_ERR_NOT_ONLINE, err.Error())
+		case ErrIdentityMismatch:
+			rpcErr = InvalidInput(err.Error())
+		case ErrTopicForbidden:
+			rpcErr = NewRpcError(RPC_ERR_FORBIDDEN, err.Error())
+		case mgo.ErrNotFound:
+			rpcErr = NewRpcError(RPC_ERR_NOT_FOUND, "Not found")
+		case ErrRpcTimeout:
+			log.Printf("RPC %s [%s] timed out\n", ctx.Method, ctx.TraceId)
+			rpcErr = NewRpcError(RPC_ERR_TIMEOUT, err.Error())
+		default:
+			log.Printf("RPC %s [%s] failed: %s\n", ctx.Method, ctx.TraceId, err)
+			rpcErr = NewRpcError(RPC_ERR_INTERNAL, "Internal error")
+		}
+	}
+
+	code, ok := rpcErrorCodes[rpcErr.Kind]
+	if !ok {
+		code = jsonrpc2.INTERNAL_ERROR
+	}
+
+	return &jsonrpc2.Error{
+		Code:    code,
+		Message: rpcErr.Message,
+		Data:    RpcErrorData{Kind: rpcErr.Kind, CorrelationId: ctx.TraceId},
+	}
+}
+
+// Turn the panic of the call into an internal error, logged with the trace id
+func recoverRpcPanic(ctx *RpcContext, err *error) {
+	if x := recover(); x != nil {
+		log.Printf("RPC %s [%s] panic: %+v\n%s", ctx.Method, ctx.TraceId, x, debug.Stack())
+		*err = fmt.Errorf("panic: %v", x)
+	}
+}
@@ -0,0 +1,277 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/kobeld/qortex-realtime/jsonrpc2"
+	"github.com/kobeld/qortex-realtime/models/ws"
+	"labix.org/v2/mgo"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestToRpcError(t *testing.T) {
+	ctx := &RpcContext{Method: "Counter.Refresh", TraceId: "trace"}
+
+	cases := []struct {
+		name    string
+		err     error
+		code    int
+		kind    string
+		message string
+	}{
+		{"invalid input", InvalidInput("EntryId is required"), jsonrpc2.INVALID_PARAMS, RPC_ERR_INVALID_INPUT, "EntryId is required"},
+		{"not online rpc error", NewRpcError(RPC_ERR_NOT_ONLINE, "Gone"), -32001, RPC_ERR_NOT_ONLINE, "Gone"},
+		{"forbidden rpc error", NewRpcError(RPC_ERR_FORBIDDEN, "No"), -32003, RPC_ERR_FORBIDDEN, "No"},
+		{"not found rpc error", NewRpcError(RPC_ERR_NOT_FOUND, "Nothing"), -32004, RPC_ERR_NOT_FOUND, "Nothing"},
+		{"internal rpc error", NewRpcError(RPC_ERR_INTERNAL, "Oops"), jsonrpc2.INTERNAL_ERROR, RPC_ERR_INTERNAL, "Oops"},
+		{"unknown kind", NewRpcError("weird", "Weird"), jsonrpc2.INTERNAL_ERROR, "weird", "Weird"},
+		{"user not online", ws.ErrUserNotOnline, -32001, RPC_ERR_NOT_ONLINE, ws.ErrUserNotOnline.Error()},
+		{"identity mismatch", ErrIdentityMismatch, jsonrpc2.INVALID_PARAMS, RPC_ERR_INVALID_INPUT, ErrIdentityMismatch.Error()},
+		{"topic forbidden", ErrTopicForbidden, -32003, RPC_ERR_FORBIDDEN, ErrTopicForbidden.Error()},
+		{"mongo not found", mgo.ErrNotFound, -32004, RPC_ERR_NOT_FOUND, "Not found"},
+		{"timeout", ErrRpcTimeout, -32008, RPC_ERR_TIMEOUT, ErrRpcTimeout.Error()},
+		{"unexpected", errors.New("connection refused 10.0.0.1"), jsonrpc2.INTERNAL_ERROR, RPC_ERR_INTERNAL, "Internal error"},
+	}
+
+	for _, c := range cases {
+		rpcErr := toRpcError(c.err, ctx)
+		if rpcErr.Code != c.code || rpcErr.Message != c.message {
+			t.Errorf("%s: expected %d %q, got %d %q", c.name, c.code, c.message, rpcErr.Code, rpcErr.Message)
+		}
+
+		data, ok := rpcErr.Data.(RpcErrorData)
+		if !ok || data.Kind != c.kind || data.CorrelationId != "trace" {
+			t.Errorf("%s: expected kind %s with the trace id, got %+v", c.name, c.kind, rpcErr.Data)
+		}
+	}
+
+	// The protocol errors of the router are kept
+	protocolErr := jsonrpc2.NewError(jsonrpc2.METHOD_NOT_FOUND, "Method not found: Nope.Nope")
+	if rpcErr := toRpcError(protocolErr, ctx); rpcErr != protocolErr {
+		t.Errorf("expected the protocol error kept, got %+v", rpcErr)
+	}
+}
+
+// Fails the way the input asks
+type RpcErrorTest int
+
+// Set when a slow call returns, and the most slow calls running at a time
+var (
+	slowCallReturned int32
+	slowCallsRunning int32
+	slowCallsMost    int32
+)
+
+type RpcErrorTestInput struct {
+	RpcInput
+	Fail string
+}
+
+func (this *RpcErrorTest) Call(input *RpcErrorTestInput, reply *CountNotification) error {
+	switch input.Fail {
+	case "panic":
+		panic("boom")
+	case "invalid":
+		return InvalidInput("Invalid")
+	case "slow":
+		running := atomic.AddInt32(&slowCallsRunning, 1)
+		for most := atomic.LoadInt32(&slowCallsMost); running > most; most = atomic.LoadInt32(&slowCallsMost) {
+			if atomic.CompareAndSwapInt32(&slowCallsMost, most, running) {
+				break
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+		atomic.AddInt32(&slowCallsRunning, -1)
+		atomic.StoreInt32(&slowCallReturned, 1)
+	}
+	return nil
+}
+
+var registerRpcErrorTest sync.Once
+
+func newTestRpcSlot(size int) *rpcSlot {
+	return &rpcSlot{slots: make(chan bool, size)}
+}
+
+func TestRpcErrorResponses(t *testing.T) {
+	registerRpcErrorTest.Do(func() { rpcRouter.Register(new(RpcErrorTest)) })
+
+	activeOrg := newTestActiveOrg()
+	defer removeTestActiveOrg(activeOrg)
+	_, conn := newTestUser(activeOrg)
+
+	cases := []struct {
+		name string
+		req  string
+		code int
+	}{
+		{"ok", `{"jsonrpc":"2.0","id":1,"method":"RpcErrorTest.Call","params":{}}`, 0},
+		{"invalid input", `{"jsonrpc":"2.0","id":1,"method":"RpcErrorTest.Call","params":{"Fail":"invalid"}}`, jsonrpc2.INVALID_PARAMS},
+		{"panic", `{"jsonrpc":"2.0","id":1,"method":"RpcErrorTest.Call","params":{"Fail":"panic"}}`, jsonrpc2.INTERNAL_ERROR},
+		{"bad params", `{"jsonrpc":"2.0","id":1,"method":"RpcErrorTest.Call","params":{"Fail":1}}`, jsonrpc2.INVALID_PARAMS},
+		{"method not found", `{"jsonrpc":"2.0","id":1,"method":"Nope.Nope"}`, jsonrpc2.METHOD_NOT_FOUND},
+		{"invalid request", `{"jsonrpc":"1.0","id":1,"method":"RpcErrorTest.Call"}`, jsonrpc2.INVALID_REQUEST},
+		{"not a request", `[]`, jsonrpc2.INVALID_REQUEST},
+	}
+
+	for _, c := range cases {
+		resp := handleRpcRequest(conn, json.RawMessage(c.req), newTestRpcSlot(1))
+		if resp == nil {
+			t.Fatalf("%s: expected a response", c.name)
+		}
+
+		code := 0
+		if resp.Error != nil {
+			code = resp.Error.Code
+		}
+		if code != c.code {
+			t.Errorf("%s: expected code %d, got %d", c.name, c.code, code)
+		}
+	}
+
+	// The notifications get no response, even failing
+	notification := `{"jsonrpc":"2.0","method":"RpcErrorTest.Call","params":{"Fail":"panic"}}`
+	if resp := handleRpcRequest(conn, json.RawMessage(notification), newTestRpcSlot(1)); resp != nil {
+		t.Errorf("expected no response to the notification, got %+v", resp)
+	}
+}
+
+func TestRpcDeadline(t *testing.T) {
+	registerRpcErrorTest.Do(func() { rpcRouter.Register(new(RpcErrorTest)) })
+
+	oldTimeout := config.RpcTimeout.Duration
+	config.RpcTimeout.Duration = 10 * time.Millisecond
+	defer func() { config.RpcTimeout.Duration = oldTimeout }()
+
+	activeOrg := newTestActiveOrg()
+	defer removeTestActiveOrg(activeOrg)
+	_, conn := newTestUser(activeOrg)
+	atomic.StoreInt32(&slowCallReturned, 0)
+
+	slot := newTestRpcSlot(1)
+	req := `{"jsonrpc":"2.0","id":1,"method":"RpcErrorTest.Call","params":{"Fail":"slow"}}`
+	resp := handleRpcRequest(conn, json.RawMessage(req), slot)
+	if resp == nil || resp.Error == nil || resp.Error.Code != -32008 {
+		t.Fatalf("expected a timeout, got %+v", resp)
+	}
+	if atomic.LoadInt32(&slowCallReturned) != 0 {
+		t.Fatal("expected the timeout before the call returns")
+	}
+
+	// The call still holds the connection's slot until it returns
+	if slot.holding || len(slot.slots) != 1 {
+		t.Fatal("expected the slot handed over to the call")
+	}
+	waitUntil(t, "the call to give back the slot", func() bool {
+		return len(slot.slots) == 0
+	})
+	if atomic.LoadInt32(&slowCallReturned) != 1 {
+		t.Fatal("expected the call returned")
+	}
+}
+
+// The calls of a batch past their deadline keep their slots, the next ones wait for them
+func TestRpcDeadlineInBatch(t *testing.T) {
+	registerRpcErrorTest.Do(func() { rpcRouter.Register(new(RpcErrorTest)) })
+
+	oldTimeout := config.RpcTimeout.Duration
+	config.RpcTimeout.Duration = 10 * time.Millisecond
+	defer func() { config.RpcTimeout.Duration = oldTimeout }()
+
+	activeOrg := newTestActiveOrg()
+	defer removeTestActiveOrg(activeOrg)
+	_, conn := newTestUser(activeOrg)
+	atomic.StoreInt32(&slowCallsMost, 0)
+
+	slow := `{"jsonrpc":"2.0","id":1,"method":"RpcErrorTest.Call","params":{"Fail":"slow"}}`
+	slot := newTestRpcSlot(1)
+	slot.take()
+	handleRpcMessage(conn, []byte("["+slow+","+slow+","+slow+"]"), slot)
+	slot.release()
+
+	waitUntil(t, "the calls to return", func() bool {
+		return len(slot.slots) == 0
+	})
+	if most := atomic.LoadInt32(&slowCallsMost); most != 1 {
+		t.Fatalf("expected one call at a time, got %d", most)
+	}
+}
+
+// The responses queued on the connection, as "<id>:<error code>" (0 for a result).
+// The responses of a batch are in brackets.
+func popResponses(conn *ws.Connection) (responses []string) {
+	for conn.Queue.Len() > 0 {
+		msg, _ := conn.Queue.Pop()
+		switch resp := msg.(type) {
+		case *jsonrpc2.Response:
+			responses = append(responses, describeResponse(resp))
+		case []*jsonrpc2.Response:
+			var batch []string
+			for _, r := range resp {
+				batch = append(batch, describeResponse(r))
+			}
+			responses = append(responses, "["+strings.Join(batch, " ")+"]")
+		}
+	}
+	return
+}
+
+func describeResponse(resp *jsonrpc2.Response) string {
+	id, code := "null", 0
+	if resp.Id != nil {
+		id = string(*resp.Id)
+	}
+	if resp.Error != nil {
+		code = resp.Error.Code
+	}
+	return fmt.Sprintf("%s:%d", id, code)
+}
+
+func TestRpcMessages(t *testing.T) {
+	registerRpcErrorTest.Do(func() { rpcRouter.Register(new(RpcErrorTest)) })
+
+	oldBatchSize := config.MaxRpcBatchSize
+	config.MaxRpcBatchSize = 3
+	defer func() { config.MaxRpcBatchSize = oldBatchSize }()
+
+	activeOrg := newTestActiveOrg()
+	defer removeTestActiveOrg(activeOrg)
+	_, conn := newTestUser(activeOrg)
+
+	call := `{"jsonrpc":"2.0","id":1,"method":"RpcErrorTest.Call"}`
+	notification := `{"jsonrpc":"2.0","method":"RpcErrorTest.Call"}`
+
+	cases := []struct {
+		name      string
+		message   string
+		responses []string
+	}{
+		{"call", call, []string{"1:0"}},
+		{"null id", `{"jsonrpc":"2.0","id":null,"method":"RpcErrorTest.Call"}`, []string{"null:0"}},
+		{"notification", notification, nil},
+		{"parse error", `{"jsonrpc":`, []string{"null:-32700"}},
+		{"invalid request", `{"jsonrpc":"2.0","id":2}`, []string{"2:-32600"}},
+		{"not a request", `1`, []string{"null:-32600"}},
+		{"empty batch", `[]`, []string{"null:-32600"}},
+		{"mixed batch", "[" + call + "," + notification + `,1]`, []string{"[1:0 null:-32600]"}},
+		{"all notifications batch", "[" + notification + "," + notification + "]", nil},
+		{"too large batch", "[" + call + "," + call + "," + call + "," + call + "]", []string{"null:-32600"}},
+	}
+
+	for _, c := range cases {
+		slot := newTestRpcSlot(1)
+		slot.take()
+		handleRpcMessage(conn, []byte(c.message), slot)
+		slot.release()
+
+		responses := popResponses(conn)
+		if strings.Join(responses, ",") != strings.Join(c.responses, ",") {
+			t.Errorf("%s: expected %q, got %q", c.name, c.responses, responses)
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package services
+
+import (
+	"code.google.com/p/go.net/websocket"
+	"encoding/json"
+	"github.com/kobeld/qortex-realtime/jsonrpc2"
+	"github.com/kobeld/qortex-realtime/models/ws"
+	"time"
+)
+
+var rpcRouter = jsonrpc2.NewRouter()
+
+// Read the JSON-RPC 2.0 calls from the websocket until it is closed, or
+// the client keeps silent longer than config.IdleTimeout (see keepAlive).
+// At most config.MaxRpcPerConnection calls run at a time, the next frame
+// isn't read until one of them returns.
+// The responses go out through the connection's push queue, like the pushes.
+func serveRpc(conn messageReader, wsConn *ws.Connection) {
+	go keepAlive(wsConn)
+
+	slots := make(chan bool, config.MaxRpcPerConnection)
+	for {
+		conn.SetReadDeadline(time.Now().Add(config.IdleTimeout.Duration))
+		data, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		slot := &rpcSlot{slots: slots}
+		slot.take()
+		go func() {
+			defer slot.release()
+			handleRpcMessage(wsConn, data, slot)
+		}()
+	}
+}
+
+// What serveRpc reads the messages from
+type messageReader interface {
+	SetReadDeadline(t time.Time) error
+	ReadMessage() ([]byte, error)
+}
+
+type wsMessageReader struct {
+	*websocket.Conn
+}
+
+func (this wsMessageReader) ReadMessage() (data []byte, err error) {
+	err = websocket.Message.Receive(this.Conn, &data)
+	return
+}
+
+// One of the config.MaxRpcPerConnection slots. A message holds one while it
+// runs its calls, a call past its deadline takes it over until it returns,
+// then the message takes another one for its next call.
+type rpcSlot struct {
+	slots   chan bool
+	holding bool
+}
+
+func (this *rpcSlot) take() {
+	if !this.holding {
+		this.slots <- true
+		this.holding = true
+	}
+}
+
+func (this *rpcSlot) release() {
+	if this.holding {
+		<-this.slots
+		this.holding = false
+	}
+}
+
+// Hand the slot over to the call running past its deadline, it calls the
+// returned func when it returns
+func (this *rpcSlot) handOver() (release func()) {
+	this.holding = false
+	return func() { <-this.slots }
+}
+
+func handleRpcMessage(wsConn *ws.Connection, data []byte, slot *rpcSlot) {
+	raws, isBatch, rpcErr := jsonrpc2.ParseMessage(data, config.MaxRpcBatchSize)
+	if rpcErr != nil {
+		respond(wsConn, jsonrpc2.NewErrorResponse(nil, rpcErr))
+		return
+	}
+
+	responses := []*jsonrpc2.Response{}
+	for _, raw := range raws {
+		if resp := handleRpcRequest(wsConn, raw, slot); resp != nil {
+			responses = append(responses, resp)
+		}
+	}
+
+	// Nothing to respond if it is all notifications
+	switch {
+	case len(responses) == 0:
+	case isBatch:
+		respond(wsConn, responses)
+	default:
+		respond(wsConn, responses[0])
+	}
+}
+
+// Call the method, returns nil for the notifications. It waits for the
+// method until ctx.Deadline.
+func handleRpcRequest(wsConn *ws.Connection, raw json.RawMessage, slot *rpcSlot) *jsonrpc2.Response {
+	req, rpcErr := jsonrpc2.ParseRequest(raw)
+	if rpcErr != nil {
+		var id *json.RawMessage
+		if req != nil {
+			id = req.Id
+		}
+		return jsonrpc2.NewErrorResponse(id, rpcErr)
+	}
+
+	slot.take()
+	ctx := newRpcContext(wsConn, req.Method)
+	reply, err := callRpcUntilDeadline(ctx, req, slot)
+
+	if req.IsNotification() {
+		return nil
+	}
+	if err != nil {
+		return jsonrpc2.NewErrorResponse(req.Id, toRpcError(err, ctx))
+	}
+	return jsonrpc2.NewResult(req.Id, reply)
+}
+
+type rpcResult struct {
+	reply interface{}
+	err   error
+}
+
+func callRpcUntilDeadline(ctx *RpcContext, req *jsonrpc2.Request, slot *rpcSlot) (reply interface{}, err error) {
+	done := make(chan rpcResult, 1)
+	go func() {
+		reply, err := callRpc(ctx, req)
+		done <- rpcResult{reply, err}
+	}()
+
+	timer := time.NewTimer(ctx.Deadline.Sub(time.Now()))
+	defer timer.Stop()
+
+	select {
+	case result := <-done:
+		return result.reply, result.err
+	case <-timer.C:
+		release := slot.handOver()
+		go func() {
+			<-done
+			release()
+		}()
+		return nil, ErrRpcTimeout
+	}
+}
+
+func callRpc(ctx *RpcContext, req *jsonrpc2.Request) (reply interface{}, err error) {
+	defer recoverRpcPanic(ctx, &err)
+	return rpcRouter.Call(req.Method, req.Params, bindRpcContext(ctx))
+}
+
+func respond(wsConn *ws.Connection, msg ws.GenericPushingMessage) {
+	if !wsConn.Respond(msg) {
+		wsConn.Owner.KillConnection(wsConn)
+	}
+}
@@ -0,0 +1,77 @@
+package services
+
+import (
+	"github.com/kobeld/qortex-realtime/models/ws"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	SERVER_RECONNECT = "Server.Reconnect"
+)
+
+// Server level push, asking the clients to do something with the connection
+type ServerNotification struct {
+	Method string
+}
+
+func (this ServerNotification) PushMethod() string {
+	return this.Method
+}
+
+var shuttingDown int32
+
+func IsShuttingDown() bool {
+	return atomic.LoadInt32(&shuttingDown) == 1
+}
+
+// Stop accepting new connections and ask every online user to reconnect,
+// so they can land on another (or the restarted) server.
+func StartShutdown() {
+	atomic.StoreInt32(&shuttingDown, 1)
+
+	for _, onlineUser := range allOnlineUsers() {
+		onlineUser.SendReply(ServerNotification{Method: SERVER_RECONNECT})
+	}
+}
+
+// Flush the pending pushes, close the websockets and write the offline time
+// for every online user, giving up when the deadline passed.
+func FinishShutdown(deadline time.Time) {
+	var wg sync.WaitGroup
+
+	for _, onlineUser := range allOnlineUsers() {
+		wg.Add(1)
+		go func(onlineUser *ws.OnlineUser) {
+			defer wg.Done()
+			onlineUser.Drain(deadline)
+			onlineUser.UpdateOfflineTime()
+		}(onlineUser)
+	}
+
+	done := make(chan bool)
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(deadline.Sub(time.Now())):
+		log.Println("Shutdown: deadline exceeded, some online users are not flushed")
+	}
+
+	// The users are moving to the other servers, not going offline
+	LeaveCluster()
+	StopOfflineQueue()
+	StopMailer(deadline)
+}
+
+func allOnlineUsers() (onlineUsers []*ws.OnlineUser) {
+	for _, activeOrg := range allActiveOrgs() {
+		onlineUsers = append(onlineUsers, activeOrg.OnlineUserList()...)
+	}
+	return
+}
@@ -0,0 +1,238 @@
+package services
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/kobeld/qortex-realtime/cluster"
+	"github.com/kobeld/qortex-realtime/models/ws"
+	"github.com/theplant/qortex/entries"
+	"github.com/theplant/qortex/utils"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"strings"
+)
+
+// Kinds of the topics, a topic is "<kind>:<id>"
+const (
+	TOPIC_GROUP        = "group"
+	TOPIC_ENTRY        = "entry"
+	TOPIC_CONVERSATION = "conversation"
+
+	MAX_TOPICS_PER_CONNECTION = 64
+)
+
+var (
+	ErrTopicForbidden = errors.New("Can't subscribe the topic")
+	ErrTooManyTopics  = errors.New("Too many topics on the connection")
+)
+
+func groupTopic(groupId string) string {
+	return TOPIC_GROUP + ":" + groupId
+}
+
+func entryTopic(entryId string) string {
+	return TOPIC_ENTRY + ":" + entryId
+}
+
+func conversationTopic(conversationId string) string {
+	return TOPIC_CONVERSATION + ":" + conversationId
+}
+
+func parseTopic(topic string) (kind, id string, ok bool) {
+	parts := strings.SplitN(topic, ":", 2)
+	if len(parts) != 2 || !bson.IsObjectIdHex(parts[1]) {
+		return
+	}
+
+	switch parts[0] {
+	case TOPIC_GROUP, TOPIC_ENTRY, TOPIC_CONVERSATION:
+		return parts[0], parts[1], true
+	}
+	return
+}
+
+// The access checks of the topics, swappable with fakes. A nil error means
+// the user can view it.
+type TopicGuard interface {
+	CanViewGroup(serv *WsService, groupId string) error
+	CanViewEntry(serv *WsService, entryId string) error
+	CanViewConversation(serv *WsService, conversationId string) error
+}
+
+var topicGuard TopicGuard = new(qortexTopicGuard)
+
+// Asks the qortex services, which only return what the user can see
+type qortexTopicGuard struct{}
+
+func (this *qortexTopicGuard) CanViewGroup(serv *WsService, groupId string) error {
+	_, err := serv.GetGroup(groupId)
+	return forbiddenUnlessNotFound(err)
+}
+
+func (this *qortexTopicGuard) CanViewConversation(serv *WsService, conversationId string) error {
+	_, err := serv.GetConversation(conversationId)
+	return forbiddenUnlessNotFound(err)
+}
+
+// The entry is visible if its group or conversation is
+func (this *qortexTopicGuard) CanViewEntry(serv *WsService, entryId string) error {
+	for _, db := range serv.AllDBs {
+		entry, err := entries.FindById(db, bson.ObjectIdHex(entryId))
+		if err == mgo.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if entry.ConversationId.Valid() {
+			return this.CanViewConversation(serv, entry.ConversationId.Hex())
+		}
+		return this.CanViewGroup(serv, entry.GroupId.Hex())
+	}
+	return mgo.ErrNotFound
+}
+
+func forbiddenUnlessNotFound(err error) error {
+	if err == nil || err == mgo.ErrNotFound {
+		return err
+	}
+	utils.PrintStackAndError(err)
+	return ErrTopicForbidden
+}
+
+type Topic int
+
+type TopicInput struct {
+	RpcInput
+	Topic string
+}
+
+// Get the pushes of a group, entry or conversation on this connection,
+// e.g. the comments and likes of the entry the user is looking at
+func (this *Topic) Subscribe(input *TopicInput, reply *bool) (err error) {
+	kind, id, ok := parseTopic(input.Topic)
+	if !ok {
+		return InvalidInput("Topic should be like group:<id>, entry:<id> or conversation:<id>")
+	}
+
+	ctx := input.Context()
+	if ctx.Conn.IsSubscribed(input.Topic) {
+		*reply = true
+		return
+	}
+	if ctx.Conn.SubscriptionCount() >= MAX_TOPICS_PER_CONNECTION {
+		return InvalidInput(ErrTooManyTopics.Error())
+	}
+
+	if err = authorizeTopic(ctx, kind, id); err != nil {
+		return
+	}
+	if err = ctx.CheckDeadline(); err != nil {
+		return
+	}
+
+	ctx.Conn.Subscribe(input.Topic)
+	*reply = true
+	return
+}
+
+func authorizeTopic(ctx *RpcContext, kind, id string) (err error) {
+	serv, err := ctx.WsService()
+	if err != nil {
+		return
+	}
+
+	switch kind {
+	case TOPIC_GROUP:
+		err = topicGuard.CanViewGroup(serv, id)
+	case TOPIC_ENTRY:
+		err = topicGuard.CanViewEntry(serv, id)
+	case TOPIC_CONVERSATION:
+		err = topicGuard.CanViewConversation(serv, id)
+	}
+	return
+}
+
+func (this *Topic) Unsubscribe(input *TopicInput, reply *bool) (err error) {
+	if _, _, ok := parseTopic(input.Topic); !ok {
+		return InvalidInput("Unknown topic: " + input.Topic)
+	}
+
+	input.Context().Conn.Unsubscribe(input.Topic)
+	*reply = true
+	return
+}
+
+// The topic push forwarded to the other nodes
+type topicPushPayload struct {
+	Topics []string
+	Method string
+	Body   json.RawMessage
+}
+
+// A push coming from another node, written as it is
+type rawPush struct {
+	Method string
+	Body   json.RawMessage
+}
+
+func (this rawPush) PushMethod() string {
+	return this.Method
+}
+
+func (this rawPush) MarshalJSON() ([]byte, error) {
+	return this.Body, nil
+}
+
+// Push to the topic subscribers of the organization (and the ones sharing it)
+// on every node, except the connections of the user. A connection subscribing
+// several of the topics gets it once.
+func pushToTopics(orgId string, topics []string, msg ws.MethodPush, exceptUserId bson.ObjectId) {
+	pushToLocalTopics(orgId, topics, msg, exceptUserId)
+
+	if backplane == nil {
+		return
+	}
+
+	body, err := json.Marshal(msg)
+	if err != nil {
+		utils.PrintStackAndError(err)
+		return
+	}
+
+	payload, err := json.Marshal(topicPushPayload{Topics: topics, Method: msg.PushMethod(), Body: body})
+	if err != nil {
+		utils.PrintStackAndError(err)
+		return
+	}
+
+	publishToCluster(&cluster.Message{
+		Kind:    cluster.KIND_TOPIC,
+		OrgId:   orgId,
+		UserId:  exceptUserId.Hex(),
+		Payload: payload,
+	})
+}
+
+func handleTopicMessage(msg *cluster.Message) {
+	payload := new(topicPushPayload)
+	if err := json.Unmarshal(msg.Payload, payload); err != nil {
+		utils.PrintStackAndError(err)
+		return
+	}
+
+	var exceptUserId bson.ObjectId
+	if bson.IsObjectIdHex(msg.UserId) {
+		exceptUserId = bson.ObjectIdHex(msg.UserId)
+	}
+	pushToLocalTopics(msg.OrgId, payload.Topics, rawPush{Method: payload.Method, Body: payload.Body}, exceptUserId)
+}
+
+func pushToLocalTopics(orgId string, topics []string, msg ws.GenericPushingMessage, exceptUserId bson.ObjectId) {
+	for _, activeOrg := range allActiveOrgs() {
+		if activeOrg.OrgId == orgId || embedsOrg(activeOrg, orgId) {
+			activeOrg.PushToOthers(topics, msg, exceptUserId)
+		}
+	}
+}
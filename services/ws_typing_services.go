@@ -0,0 +1,154 @@
+package services
+
+import (
+	"github.com/kobeld/qortex-realtime/models/ws"
+	"labix.org/v2/mgo/bson"
+	"sync"
+	"time"
+)
+
+const (
+	TYPING = "Typing"
+)
+
+// Pushed to the others viewing the entry or conversation. Typing is false
+// when the user stops, or hasn't called Typing.Start for config.TypingTimeout.
+// Clients should also forget it after ExpiresAt, in case the stop is lost.
+type TypingNotification struct {
+	Method         string
+	UserId         string
+	OrgId          string
+	EntryId        string
+	ConversationId string
+	Typing         bool
+	ExpiresAt      time.Time
+}
+
+func (this TypingNotification) PushMethod() string {
+	return this.Method
+}
+
+// One user typing in one entry or conversation. Nothing is saved, the state
+// lives on the node of the typing connection only.
+type typingKey struct {
+	userId bson.ObjectId
+	topic  string
+}
+
+type typingState struct {
+	reply    TypingNotification
+	pushedAt time.Time
+	timer    *time.Timer
+}
+
+var (
+	typingMu     sync.Mutex
+	typingStates = make(map[typingKey]*typingState)
+)
+
+type Typing int
+
+type TypingInput struct {
+	RpcInput
+	EntryId        string
+	ConversationId string
+}
+
+// The topic of the entry or conversation, one of them is required
+func (this *TypingInput) topic() (topic string, err error) {
+	switch {
+	case this.EntryId != "" && this.ConversationId == "":
+		topic = entryTopic(this.EntryId)
+	case this.ConversationId != "" && this.EntryId == "":
+		topic = conversationTopic(this.ConversationId)
+	}
+
+	if _, _, ok := parseTopic(topic); !ok {
+		err = InvalidInput("Either a valid EntryId or ConversationId is required")
+	}
+	return
+}
+
+// Called while the user types, it can be called on every key stroke
+func (this *Typing) Start(input *TypingInput, reply *bool) (err error) {
+	topic, err := input.topic()
+	if err != nil {
+		return
+	}
+
+	// Only the ones who can see it get the typing pushes
+	ctx := input.Context()
+	if !ctx.Conn.IsSubscribed(topic) {
+		kind, id, _ := parseTopic(topic)
+		if err = authorizeTopic(ctx, kind, id); err != nil {
+			return
+		}
+		ctx.Conn.View(topic)
+	}
+
+	startTyping(ctx.OnlineUser, topic, TypingNotification{
+		Method:         TYPING,
+		UserId:         ctx.OnlineUser.User.Id.Hex(),
+		OrgId:          ctx.ActiveOrg.OrgId,
+		EntryId:        input.EntryId,
+		ConversationId: input.ConversationId,
+	})
+	*reply = true
+	return
+}
+
+// Called when the user sends the comment/message, or clears the input
+func (this *Typing) Stop(input *TypingInput, reply *bool) (err error) {
+	topic, err := input.topic()
+	if err != nil {
+		return
+	}
+
+	stopTyping(typingKey{userId: input.Context().OnlineUser.User.Id, topic: topic})
+	*reply = true
+	return
+}
+
+func startTyping(onlineUser *ws.OnlineUser, topic string, reply TypingNotification) {
+	key := typingKey{userId: onlineUser.User.Id, topic: topic}
+	now := time.Now()
+	timeout := config.TypingTimeout.Duration
+
+	typingMu.Lock()
+	state, exist := typingStates[key]
+	if exist {
+		state.timer.Reset(timeout)
+		if now.Sub(state.pushedAt) < config.TypingThrottle.Duration {
+			typingMu.Unlock()
+			return
+		}
+	} else {
+		state = &typingState{timer: time.AfterFunc(timeout, func() { stopTyping(key) })}
+		typingStates[key] = state
+	}
+
+	reply.Typing = true
+	reply.ExpiresAt = now.Add(timeout)
+	state.reply = reply
+	state.pushedAt = now
+	typingMu.Unlock()
+
+	pushToTopics(reply.OrgId, []string{topic}, reply, key.userId)
+}
+
+func stopTyping(key typingKey) {
+	typingMu.Lock()
+	state, exist := typingStates[key]
+	if !exist {
+		typingMu.Unlock()
+		return
+	}
+	state.timer.Stop()
+	delete(typingStates, key)
+	typingMu.Unlock()
+
+	reply := state.reply
+	reply.Typing = false
+	reply.ExpiresAt = time.Now()
+	pushToTopics(reply.OrgId, []string{key.topic}, reply, key.userId)
+}
@@ -0,0 +1,114 @@
+package services
+
+import (
+	"github.com/kobeld/qortex-realtime/models/ws"
+	"labix.org/v2/mgo/bson"
+	"testing"
+	"time"
+)
+
+func useTyping(throttle, timeout time.Duration) (restore func()) {
+	oldThrottle, oldTimeout := config.TypingThrottle.Duration, config.TypingTimeout.Duration
+	config.TypingThrottle.Duration, config.TypingTimeout.Duration = throttle, timeout
+	return func() {
+		config.TypingThrottle.Duration, config.TypingTimeout.Duration = oldThrottle, oldTimeout
+	}
+}
+
+// The typing pushes queued on the connection, taking them out of the queue
+func popTyping(conn *ws.Connection) (typing []bool) {
+	for conn.Queue.Len() > 0 {
+		msg, _ := conn.Queue.Pop()
+		if reply, ok := msg.(TypingNotification); ok {
+			typing = append(typing, reply.Typing)
+		}
+	}
+	return
+}
+
+// The typer and a watcher viewing the same entry
+func newTypingTest() (activeOrg *ws.ActiveOrg, typer *ws.OnlineUser, typerConn, watcherConn *ws.Connection, entryId string) {
+	activeOrg = newTestActiveOrg()
+	typer, typerConn = newTestUser(activeOrg)
+	_, watcherConn = newTestUser(activeOrg)
+
+	entryId = bson.NewObjectId().Hex()
+	typerConn.View(entryTopic(entryId))
+	watcherConn.View(entryTopic(entryId))
+	return
+}
+
+func startTypingIn(t *testing.T, conn *ws.Connection, entryId string) {
+	input := &TypingInput{EntryId: entryId}
+	input.setContext(newRpcContext(conn, "Typing.Start"))
+	if err := new(Typing).Start(input, new(bool)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func stopTypingIn(t *testing.T, conn *ws.Connection, entryId string) {
+	input := &TypingInput{EntryId: entryId}
+	input.setContext(newRpcContext(conn, "Typing.Stop"))
+	if err := new(Typing).Stop(input, new(bool)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTypingThrottled(t *testing.T) {
+	defer useTyping(30*time.Millisecond, time.Minute)()
+
+	activeOrg, _, typerConn, watcherConn, entryId := newTypingTest()
+	defer removeTestActiveOrg(activeOrg)
+
+	// Key strokes within the throttle window push once
+	for i := 0; i < 3; i++ {
+		startTypingIn(t, typerConn, entryId)
+	}
+	if typing := popTyping(watcherConn); len(typing) != 1 || !typing[0] {
+		t.Fatalf("expected one typing push, got %v", typing)
+	}
+
+	time.Sleep(40 * time.Millisecond)
+	startTypingIn(t, typerConn, entryId)
+	if typing := popTyping(watcherConn); len(typing) != 1 || !typing[0] {
+		t.Fatalf("expected another typing push after the window, got %v", typing)
+	}
+
+	stopTypingIn(t, typerConn, entryId)
+	stopTypingIn(t, typerConn, entryId)
+	if typing := popTyping(watcherConn); len(typing) != 1 || typing[0] {
+		t.Fatalf("expected one stop push, got %v", typing)
+	}
+
+	// The typer never gets its own pushes
+	if typing := popTyping(typerConn); len(typing) != 0 {
+		t.Fatalf("expected nothing pushed to the typer, got %v", typing)
+	}
+}
+
+func TestTypingStopsByItself(t *testing.T) {
+	defer useTyping(time.Minute, 20*time.Millisecond)()
+
+	activeOrg, typer, typerConn, watcherConn, entryId := newTypingTest()
+	defer removeTestActiveOrg(activeOrg)
+
+	startTypingIn(t, typerConn, entryId)
+	var typing []bool
+	waitUntil(t, "the typing to stop", func() bool {
+		typing = append(typing, popTyping(watcherConn)...)
+		return len(typing) == 2
+	})
+	if !typing[0] || typing[1] {
+		t.Fatalf("expected typing then stopped, got %v", typing)
+	}
+
+	typingMu.Lock()
+	_, left := typingStates[typingKey{userId: typer.User.Id, topic: entryTopic(entryId)}]
+	typingMu.Unlock()
+	if left {
+		t.Fatal("expected the typing state gone")
+	}
+	if typing := popTyping(typerConn); len(typing) != 0 {
+		t.Fatalf("expected nothing pushed to the typer, got %v", typing)
+	}
+}
@@ -0,0 +1,100 @@
+package services
+
+import (
+	"github.com/kobeld/qortex-realtime/configs"
+	"labix.org/v2/mgo"
+	"labix.org/v2/mgo/bson"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	USED_TICKETS_COLLECTION = "realtime_used_tickets"
+)
+
+// Remembers the used tickets until they expire. Use returns false if the
+// ticket has been used already, on any node sharing the store.
+type UsedTicketStore interface {
+	Use(orgIdHex, ticketId string, expires time.Time) (first bool, err error)
+}
+
+func newUsedTicketStore(cfg *configs.Config) UsedTicketStore {
+	if cfg.TicketStore == configs.STORE_MEMORY {
+		return NewMemoryUsedTicketStore()
+	}
+	return new(MongoUsedTicketStore)
+}
+
+// Kept in the process, for a single node
+type MemoryUsedTicketStore struct {
+	used map[string]time.Time
+	lock sync.Mutex
+}
+
+func NewMemoryUsedTicketStore() *MemoryUsedTicketStore {
+	return &MemoryUsedTicketStore{used: make(map[string]time.Time)}
+}
+
+func (this *MemoryUsedTicketStore) Use(orgIdHex, ticketId string, expires time.Time) (bool, error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+
+	now := time.Now()
+	for id, e := range this.used {
+		if now.After(e) {
+			delete(this.used, id)
+		}
+	}
+
+	if _, used := this.used[ticketId]; used {
+		return false, nil
+	}
+	this.used[ticketId] = expires
+	return true, nil
+}
+
+// Kept in the database of the organization the ticket is for, expired by a
+// TTL index. The ticket id is the _id, so only one node can insert it.
+type MongoUsedTicketStore struct{}
+
+func (this *MongoUsedTicketStore) Use(orgIdHex, ticketId string, expires time.Time) (first bool, err error) {
+	if !bson.IsObjectIdHex(orgIdHex) {
+		err = ErrInvalidTicket
+		return
+	}
+	org, err := directory.FindOrg(bson.ObjectIdHex(orgIdHex))
+	if err != nil {
+		return
+	}
+
+	org.Database.CollectionDo(USED_TICKETS_COLLECTION, func(c *mgo.Collection) {
+		ensureUsedTicketIndex(orgIdHex, c)
+
+		var info *mgo.ChangeInfo
+		info, err = c.Upsert(bson.M{"_id": ticketId}, bson.M{"$setOnInsert": bson.M{"expiresat": expires}})
+		first = err == nil && info != nil && info.UpsertedId != nil
+	})
+	return
+}
+
+var (
+	ticketIndexedOrgsMu sync.Mutex
+	ticketIndexedOrgs   = make(map[string]bool)
+)
+
+// Once per org since the start. Without it the used tickets stay in the
+// collection, they are still only usable once.
+func ensureUsedTicketIndex(orgIdHex string, c *mgo.Collection) {
+	ticketIndexedOrgsMu.Lock()
+	defer ticketIndexedOrgsMu.Unlock()
+
+	if ticketIndexedOrgs[orgIdHex] {
+		return
+	}
+	if err := c.EnsureIndex(mgo.Index{Key: []string{"expiresat"}, ExpireAfter: time.Second}); err != nil {
+		log.Printf("Used tickets of org %s: can't ensure the TTL index: %s\n", orgIdHex, err)
+		return
+	}
+	ticketIndexedOrgs[orgIdHex] = true
+}